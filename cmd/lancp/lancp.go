@@ -4,28 +4,81 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/nchaloult/lancp/pkg/app"
+	"github.com/nchaloult/lancp/pkg/handshake"
+	"github.com/nchaloult/lancp/pkg/passphrase"
 )
 
 const usage = `lancp
 A simple tool for easily transferring files between two machines on the same network.
 
 USAGE:
-    lancp send <file>
-    lancp receive
+    lancp send [--compress] [--streams <n>] [--interface <name>]
+               [--discovery <mode>] [--to <host>] [--udp-port <n>]
+               [--tcp-port <n>] <path>...
+    lancp receive [--stdout] [--number] [--words <n>] [--attempts <n>]
+                  [--udp-port <n>] [--tcp-port <n>]
+    lancp pair [--join] [--interface <name>] [--discovery <mode>]
+               [--to <host>] [--udp-port <n>] [--tcp-port <n>]
+    lancp log [--json] [--peer <text>] [--file <text>] [--since <duration>]
+              [--outcome <outcome>]
 
 FLAGS:
     -h, --help       Prints this usage information and exits
     -v, --version    Prints version information and exits
+        --compress   Compresses files before sending them, unless they
+                     already seem to be compressed
+        --stdout     Writes received files to stdout instead of saving them
+        --number     Adds a number to the end of the passphrase
+        --join       Asks for the passphrase displayed on the other machine
+                     instead of displaying one
+        --json       Prints audit log entries as JSON, one per line
+
+OPTIONS:
+        --streams <n>    Sends large files over n connections at the same
+                         time [default: 1]
+        --words <n>      Uses n words in the passphrase. More words are
+                         harder to guess [default: 3]
+        --attempts <n>   Gives up after n senders try the wrong passphrase
+                         [default: 5]
+        --interface <name>
+                         Only broadcasts the handshake on the network
+                         interface with this name, like "eth0", instead of
+                         on every one
+        --discovery <mode>
+                         How to find the receiver: "broadcast" sends the
+                         handshake to everyone on the network, and "mdns"
+                         looks for receivers over multicast DNS, for
+                         networks that filter broadcasts [default: broadcast]
+        --to <host>      Sends the handshake straight to the receiver with
+                         this host name or IP address, instead of finding it
+                         with --discovery. Works across routed networks
+        --udp-port <n>   Uses UDP port n for the handshake. Must be the same
+                         on both machines [default: 6969]
+        --tcp-port <n>   Uses TCP port n for everything after the handshake.
+                         Must be the same on both machines [default: 6969]
+        --peer <text>    Only shows transfers with a peer whose address or
+                         paired device name has text in it
+        --file <text>    Only shows transfers with a file whose path has text
+                         in it
+        --since <duration>
+                         Only shows transfers from the past duration, like
+                         "24h" or "90m"
+        --outcome <outcome>
+                         Only shows transfers that were "completed",
+                         "declined", or "failed"
 
 ARGS:
-    <file>    The path to a file to send
+    <path>    The path to a file or directory to send. Can be a glob pattern,
+              or "-" to send whatever is piped into stdin
 `
 
-// TODO: temporary! This config const should be read in from a global config,
-// or maybe even provided as a command-line arg.
-const port = 6969
+// defaultPort is the UDP port that the handshake takes place on, and the TCP
+// port that everything after it does, unless the user asks for other ones.
+const defaultPort = 6969
 
 func main() {
 	// Disable timestamps on messages.
@@ -40,12 +93,74 @@ func main() {
 	subcommand := os.Args[1]
 	switch subcommand {
 	case "send":
-		if numArgs != 3 {
+		var filePaths []string
+		compress := false
+		numStreams := 1
+		var ifaceName, host string
+		discovery := "broadcast"
+		udpPort, tcpPort := defaultPort, defaultPort
+		for i := 2; i < numArgs; i++ {
+			switch os.Args[i] {
+			case "--compress":
+				compress = true
+			case "--interface":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				ifaceName = os.Args[i]
+			case "--discovery":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				discovery = os.Args[i]
+			case "--to":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				host = os.Args[i]
+			case "--udp-port":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				udpPort = parsePort(os.Args[i])
+			case "--tcp-port":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				tcpPort = parsePort(os.Args[i])
+			case "--streams":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				var err error
+				if numStreams, err = strconv.Atoi(os.Args[i]); err != nil {
+					printError(fmt.Errorf("invalid number of streams: %v",
+						err))
+				}
+			default:
+				filePaths = append(filePaths, os.Args[i])
+			}
+		}
+		if len(filePaths) == 0 {
 			printUsageAndExit()
 		}
 
-		filePath := os.Args[2]
-		cfg, err := app.NewSenderConfig(filePath, port, port+1)
+		cfg, err := app.NewSenderConfig(
+			filePaths,
+			udpPort,
+			tcpPort,
+			ifaceName,
+			discovery,
+			host,
+			compress,
+			numStreams,
+		)
 		if err != nil {
 			printError(err)
 		}
@@ -54,11 +169,168 @@ func main() {
 			printError(err)
 		}
 	case "receive":
-		if numArgs != 2 {
-			printUsageAndExit()
+		toStdout := false
+		withNumber := false
+		numWords := passphrase.DefaultNumWords
+		maxAttempts := handshake.DefaultMaxAttempts
+		udpPort, tcpPort := defaultPort, defaultPort
+		for i := 2; i < numArgs; i++ {
+			switch os.Args[i] {
+			case "--stdout":
+				toStdout = true
+			case "--number":
+				withNumber = true
+			case "--words":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				var err error
+				if numWords, err = strconv.Atoi(os.Args[i]); err != nil {
+					printError(fmt.Errorf("invalid number of words: %v", err))
+				}
+			case "--attempts":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				var err error
+				if maxAttempts, err = strconv.Atoi(os.Args[i]); err != nil {
+					printError(fmt.Errorf("invalid number of attempts: %v",
+						err))
+				}
+			case "--udp-port":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				udpPort = parsePort(os.Args[i])
+			case "--tcp-port":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				tcpPort = parsePort(os.Args[i])
+			default:
+				printUsageAndExit()
+			}
 		}
 
-		cfg, err := app.NewReceiverConfig(port, port+1)
+		cfg, err := app.NewReceiverConfig(
+			udpPort,
+			tcpPort,
+			toStdout,
+			numWords,
+			withNumber,
+			maxAttempts,
+		)
+		if err != nil {
+			printError(err)
+		}
+
+		if err := cfg.Run(); err != nil {
+			printError(err)
+		}
+	case "pair":
+		join := false
+		var ifaceName, host string
+		discovery := "broadcast"
+		udpPort, tcpPort := defaultPort, defaultPort
+		for i := 2; i < numArgs; i++ {
+			switch os.Args[i] {
+			case "--join":
+				join = true
+			case "--interface":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				ifaceName = os.Args[i]
+			case "--discovery":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				discovery = os.Args[i]
+			case "--to":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				host = os.Args[i]
+			case "--udp-port":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				udpPort = parsePort(os.Args[i])
+			case "--tcp-port":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				tcpPort = parsePort(os.Args[i])
+			default:
+				printUsageAndExit()
+			}
+		}
+
+		cfg, err := app.NewPairConfig(
+			udpPort,
+			tcpPort,
+			ifaceName,
+			discovery,
+			host,
+			join,
+		)
+		if err != nil {
+			printError(err)
+		}
+
+		if err := cfg.Run(); err != nil {
+			printError(err)
+		}
+	case "log":
+		var peer, fileName, outcome string
+		var since time.Duration
+		asJSON := false
+		for i := 2; i < numArgs; i++ {
+			switch os.Args[i] {
+			case "--json":
+				asJSON = true
+			case "--peer":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				peer = os.Args[i]
+			case "--file":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				fileName = os.Args[i]
+			case "--since":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				var err error
+				if since, err = time.ParseDuration(os.Args[i]); err != nil {
+					printError(fmt.Errorf("invalid duration: %v", err))
+				}
+			case "--outcome":
+				i++
+				if i == numArgs {
+					printUsageAndExit()
+				}
+				outcome = os.Args[i]
+			default:
+				printUsageAndExit()
+			}
+		}
+
+		cfg, err := app.NewLogConfig(peer, fileName, since, outcome, asJSON)
 		if err != nil {
 			printError(err)
 		}
@@ -76,6 +348,17 @@ func printUsageAndExit() {
 	os.Exit(1)
 }
 
+// parsePort returns the port number in the provided argument, or exits if it
+// isn't a number. Whether it's a port that lancp can use is checked later.
+func parsePort(arg string) int {
+	port, err := strconv.Atoi(arg)
+	if err != nil {
+		printError(fmt.Errorf("invalid port: %v", err))
+	}
+
+	return port
+}
+
 func printError(err error) {
 	log.Fatalf("ERROR: %v", err)
 }
@@ -1,5 +1,5 @@
 module github.com/nchaloult/lancp
 
-go 1.15
+go 1.21
 
 require github.com/alsm/ioprogress v0.0.0-20170412085706-063c3725f436
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	_net "net"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/audit"
+	"github.com/nchaloult/lancp/pkg/device"
+	"github.com/nchaloult/lancp/pkg/file"
+)
+
+// newAuditEntry returns an audit log entry for a transfer in the provided
+// direction with the machine at the provided address. pairedDevice is the
+// paired device that the handshake authenticated, or nil if it was
+// authenticated with a passphrase.
+func newAuditEntry(
+	direction string,
+	peerAddr _net.Addr,
+	pairedDevice *device.Device,
+) *audit.Entry {
+	entry := &audit.Entry{
+		Direction: direction,
+		PeerAddr:  peerAddr.String(),
+	}
+	if pairedDevice != nil {
+		entry.PeerDevice = pairedDevice.Name
+		entry.PeerKey = base64.StdEncoding.EncodeToString(
+			pairedDevice.PublicKey)
+	}
+
+	return entry
+}
+
+// recordTransfer fills in the provided audit log entry with the files in the
+// provided manifest and the transfer's outcome, which depends on err, then
+// appends it to the audit log.
+//
+// Failing to write to the audit log is reported, but doesn't fail the
+// transfer, since it's already over by now.
+func recordTransfer(entry *audit.Entry, manifest file.Manifest, err error) {
+	entry.Time = time.Now()
+	entry.Files = []audit.File{}
+	for _, e := range manifest {
+		if e.IsDir {
+			continue
+		}
+		f := audit.File{Path: e.Path, Size: e.Size}
+		if !e.IsStream {
+			f.Digest = hex.EncodeToString(e.Hash[:])
+		}
+		entry.Files = append(entry.Files, f)
+	}
+	switch {
+	case errors.Is(err, file.ErrDeclined):
+		entry.Outcome = audit.OutcomeDeclined
+	case err != nil:
+		entry.Outcome = audit.OutcomeFailed
+		entry.Error = err.Error()
+	default:
+		entry.Outcome = audit.OutcomeCompleted
+	}
+
+	dir, err := device.ConfigDir()
+	if err == nil {
+		err = audit.Append(dir, entry)
+	}
+	if err != nil {
+		log.Printf("Failed to record the transfer in the audit log: %v\n", err)
+	}
+}
@@ -5,5 +5,8 @@ const (
 	handshakeTimeoutDuration = 60
 	certTimeoutDuration      = 3
 	tlsTimeoutDuration       = 3
-	fileSendRetries          = 3
+
+	// confirmationTimeoutDuration is how long the sender waits for the user on
+	// the receiver's machine to accept the transfer.
+	confirmationTimeoutDuration = 120
 )
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/audit"
+	"github.com/nchaloult/lancp/pkg/device"
+	"github.com/nchaloult/lancp/pkg/io"
+)
+
+// LogConfig stores input from command line arguments for use when lancp is run
+// with the "log" subcommand.
+type LogConfig struct {
+	// query picks out the entries in the audit log to print.
+	query audit.Query
+
+	// asJSON is true if entries should be printed just like they're stored,
+	// one JSON object per line, instead of in a human-readable format.
+	asJSON bool
+}
+
+// NewLogConfig returns a pointer to a new LogConfig struct initialized with the
+// provided arguments. Only transfers with a peer matching peer, with a file
+// matching fileName, that were recorded within the past since, and that had
+// the provided outcome are printed. Arguments that are their zero value match
+// everything.
+func NewLogConfig(
+	peer, fileName string,
+	since time.Duration,
+	outcome string,
+	asJSON bool,
+) (*LogConfig, error) {
+	switch outcome {
+	case "", audit.OutcomeCompleted, audit.OutcomeDeclined, audit.OutcomeFailed:
+	default:
+		return nil, fmt.Errorf("got outcome %q, want %q, %q, or %q", outcome,
+			audit.OutcomeCompleted, audit.OutcomeDeclined, audit.OutcomeFailed)
+	}
+	if since < 0 {
+		return nil, fmt.Errorf("got negative duration %v", since)
+	}
+
+	query := audit.Query{Peer: peer, File: fileName, Outcome: outcome}
+	if since > 0 {
+		query.Since = time.Now().Add(-since)
+	}
+
+	return &LogConfig{query, asJSON}, nil
+}
+
+// Run executes appropriate procedures when lancp is run with the "log"
+// subcommand. It prints every transfer in the audit log that matches the query,
+// from oldest to newest, to stdout.
+func (c *LogConfig) Run() error {
+	dir, err := device.ConfigDir()
+	if err != nil {
+		return fmt.Errorf("failed to find config directory: %v", err)
+	}
+	entries, err := audit.Read(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if !c.query.Matches(entry) {
+			continue
+		}
+		if c.asJSON {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return fmt.Errorf("failed to encode audit log entry: %v", err)
+			}
+			fmt.Fprintf(os.Stdout, "%s\n", line)
+			continue
+		}
+		printEntry(entry)
+	}
+
+	return nil
+}
+
+// printEntry prints the provided audit log entry to stdout in a human-readable
+// format.
+func printEntry(entry *audit.Entry) {
+	peer := entry.PeerAddr
+	if entry.PeerDevice != "" {
+		peer = fmt.Sprintf("%s (%s)", device.CleanName(entry.PeerDevice),
+			entry.PeerAddr)
+	}
+	direction := "Sent to"
+	if entry.Direction == audit.DirectionReceive {
+		direction = "Received from"
+	}
+	fmt.Fprintf(os.Stdout, "%s  %s %s: %s\n",
+		entry.Time.Local().Format("2006-01-02 15:04:05"), direction, peer,
+		entry.Outcome)
+	for _, f := range entry.Files {
+		size := "unknown size"
+		if f.Size >= 0 {
+			size = io.FormatSize(f.Size)
+		}
+		if f.Digest == "" {
+			fmt.Fprintf(os.Stdout, "    %s (%s)\n", f.Path, size)
+		} else {
+			fmt.Fprintf(os.Stdout, "    %s (%s, sha256 %s)\n", f.Path, size,
+				f.Digest)
+		}
+	}
+	if entry.Error != "" {
+		fmt.Fprintf(os.Stdout, "    Error: %s\n", entry.Error)
+	}
+}
@@ -0,0 +1,192 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nchaloult/lancp/pkg/device"
+	"github.com/nchaloult/lancp/pkg/handshake"
+	"github.com/nchaloult/lancp/pkg/net"
+	"github.com/nchaloult/lancp/pkg/passphrase"
+)
+
+// PairConfig stores input from command line arguments, as well as configs that
+// are set globally, for use when lancp is run with the "pair" subcommand.
+type PairConfig struct {
+	// port is the UDP port that the handshake takes place on, and tcpPort is
+	// the TCP port that identities are exchanged on after it.
+	port    string
+	tcpPort string
+
+	// ifaceName is the name of the network interface that the user asked for
+	// the handshake to be broadcast on when joining, or empty to broadcast on
+	// every one.
+	ifaceName string
+
+	// discovery is how the receiver is found when joining.
+	discovery handshake.Discovery
+
+	// host is the host name or IP address of the receiver that the user asked
+	// for the handshake to be sent straight to when joining, or empty to find
+	// it with discovery.
+	host string
+
+	// join is true if this machine should ask for the passphrase that's
+	// displayed on the other machine, instead of displaying one itself.
+	join bool
+}
+
+// NewPairConfig returns a pointer to a new PairConfig struct initialized with
+// the provided arguments. If ifaceName isn't empty, the handshake is only
+// broadcast on the network interface with that name. discovery is either
+// "broadcast" or "mdns". If host isn't empty, the handshake is sent straight to
+// that host instead.
+func NewPairConfig(
+	port, tcpPort int,
+	ifaceName, discovery, host string,
+	join bool,
+) (*PairConfig, error) {
+	portAsString, err := net.GetPortAsString(port)
+	if err != nil {
+		return nil, err
+	}
+	tcpPortAsString, err := net.GetPortAsString(tcpPort)
+	if err != nil {
+		return nil, err
+	}
+	if ifaceName != "" {
+		if err := net.ValidateInterface(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+	parsedDiscovery, err := handshake.ParseDiscovery(discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PairConfig{
+		portAsString,
+		tcpPortAsString,
+		ifaceName,
+		parsedDiscovery,
+		host,
+		join,
+	}, nil
+}
+
+// Run executes appropriate procedures when lancp is run with the "pair"
+// subcommand. It completes a passphrase handshake with the other machine, just
+// like a transfer would, then exchanges identities with it, and remembers the
+// other machine's identity so that transfers between them don't need a
+// passphrase anymore.
+func (c *PairConfig) Run() error {
+	dir, err := device.ConfigDir()
+	if err != nil {
+		return fmt.Errorf("failed to find config directory: %v", err)
+	}
+	identity, err := device.LoadIdentity(dir)
+	if err != nil {
+		return err
+	}
+	knownDevices, err := device.LoadKnownDevices(dir)
+	if err != nil {
+		return err
+	}
+
+	// Pairing always uses a passphrase, since that's how both machines know
+	// that they're pairing with the right one.
+	var pairedDevice *device.Device
+	if c.join {
+		conductor, err := handshake.NewSenderConductor(
+			c.port,
+			c.ifaceName,
+			c.discovery,
+			c.host,
+			handshakeTimeoutDuration,
+			os.Stdin,
+			0,
+			nil,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to prepare for the lancp handshake: %v",
+				err)
+		}
+		addr, _, sessionKey, err := conductor.ConductHandshake()
+		if err != nil {
+			return err
+		}
+		pairedDevice, err = device.PairWithReceiver(
+			net.GetTCPAddress(addr.String(), c.tcpPort),
+			identity,
+			sessionKey,
+			certTimeoutDuration,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to exchange identities: %v", err)
+		}
+	} else {
+		conductor, err := handshake.NewReceiverConductor(
+			c.port,
+			c.tcpPort,
+			handshakeTimeoutDuration,
+			0,
+			passphrase.DefaultNumWords,
+			false,
+			handshake.DefaultMaxAttempts,
+			nil,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to prepare for the lancp handshake: %v",
+				err)
+		}
+		senderAddr, _, sessionKey, err := conductor.ConductHandshake()
+		if err != nil {
+			return err
+		}
+		pairedDevice, err = device.PairWithSender(
+			identity,
+			sessionKey,
+			c.tcpPort,
+			senderAddr,
+			certTimeoutDuration,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to exchange identities: %v", err)
+		}
+	}
+
+	if err = knownDevices.Add(*pairedDevice); err != nil {
+		return err
+	}
+	log.Printf("Paired with %s\n", pairedDevice.Name)
+
+	return nil
+}
+
+// loadPairedDevices returns this machine's identity and the devices that it's
+// paired with, so that the handshake can authenticate them without a
+// passphrase. If it isn't paired with any devices, the returned identity is
+// nil, and the handshake always uses a passphrase.
+func loadPairedDevices() (*device.Identity, *device.KnownDevices, error) {
+	dir, err := device.ConfigDir()
+	if err != nil {
+		// Without a config directory, there can't be any paired devices.
+		return nil, nil, nil
+	}
+	knownDevices, err := device.LoadKnownDevices(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if knownDevices.Len() == 0 {
+		return nil, nil, nil
+	}
+	identity, err := device.LoadIdentity(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return identity, knownDevices, nil
+}
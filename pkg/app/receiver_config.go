@@ -1,76 +1,229 @@
 package app
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	_net "net"
+	"os"
+	"time"
 
+	"github.com/nchaloult/lancp/pkg/audit"
 	"github.com/nchaloult/lancp/pkg/cert"
 	"github.com/nchaloult/lancp/pkg/file"
 	"github.com/nchaloult/lancp/pkg/handshake"
+	"github.com/nchaloult/lancp/pkg/input"
 	"github.com/nchaloult/lancp/pkg/net"
+	"github.com/nchaloult/lancp/pkg/passphrase"
 )
 
 // ReceiverConfig stores input from command line arguments, as well as configs
 // that are set globally, for use when lancp is run with the "receive"
 // subcommand.
 type ReceiverConfig struct {
+	// port is the UDP port that the handshake takes place on, and tcpPort is
+	// the TCP port that everything after it does.
 	port    string
-	tlsPort string
+	tcpPort string
+
+	// toStdout is true if received files should be written to stdout instead
+	// of being saved to disk.
+	toStdout bool
+
+	// numWords is the number of words in the passphrase, and withNumber is
+	// true if a number is tacked on to the end of it.
+	numWords   int
+	withNumber bool
+
+	// maxAttempts is the number of attempts to begin the handshake that are
+	// answered before giving up.
+	maxAttempts int
 }
 
 // NewReceiverConfig returns a pointer to a new ReceiverConfig struct
 // initialized with the provided arguments.
-func NewReceiverConfig(port, tlsPort int) (*ReceiverConfig, error) {
+func NewReceiverConfig(
+	port, tcpPort int,
+	toStdout bool,
+	numWords int,
+	withNumber bool,
+	maxAttempts int,
+) (*ReceiverConfig, error) {
 	portAsString, err := net.GetPortAsString(port)
 	if err != nil {
 		return nil, err
 	}
-	tlsPortAsString, err := net.GetPortAsString(tlsPort)
+	tcpPortAsString, err := net.GetPortAsString(tcpPort)
 	if err != nil {
 		return nil, err
 	}
+	if numWords < 1 || numWords > passphrase.MaxNumWords {
+		return nil, fmt.Errorf("got %d passphrase words, want between 1 and"+
+			" %d", numWords, passphrase.MaxNumWords)
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("got %d attempts, want at least 1", maxAttempts)
+	}
 
 	return &ReceiverConfig{
-		port:    portAsString,
-		tlsPort: tlsPortAsString,
+		port:        portAsString,
+		tcpPort:     tcpPortAsString,
+		toStdout:    toStdout,
+		numWords:    numWords,
+		withNumber:  withNumber,
+		maxAttempts: maxAttempts,
 	}, nil
 }
 
 // Run executes appropriate procedures when lancp is run with the "receive"
-// subcommand. It completes an initial passphrase handshake with a sender,
-// creates a self-signed TLS certificate for that sender to use, establishes a
-// TLS connection with that sender, and receives a file.
+// subcommand. It completes an initial handshake with a sender, which only needs
+// a passphrase if the two machines aren't paired, creates a self-signed TLS
+// certificate, exchanges it for the sender's, establishes a TLS connection
+// with that sender, and receives files. Once a sender has completed the
+// handshake, the transfer is recorded in the audit log, even if it's declined
+// or fails.
 func (c *ReceiverConfig) Run() error {
+	capabilities := receiverCapabilities(c.toStdout)
+	identity, knownDevices, err := loadPairedDevices()
+	if err != nil {
+		return err
+	}
 	conductor, err := handshake.NewReceiverConductor(
 		c.port,
+		c.tcpPort,
 		handshakeTimeoutDuration,
+		capabilities,
+		c.numWords,
+		c.withNumber,
+		c.maxAttempts,
+		identity,
+		knownDevices,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to prepare for the lancp handshake: %v", err)
 	}
-	if err = conductor.ConductHandshake(); err != nil {
+	senderAddr, capabilities, sessionKey, err := conductor.ConductHandshake()
+	if err != nil {
 		return err
 	}
 
-	localAddr, err := net.GetPreferredOutboundAddr()
+	entry := newAuditEntry(audit.DirectionReceive, senderAddr,
+		conductor.PairedDevice())
+	manifest, err := c.receive(senderAddr, capabilities, sessionKey)
+	recordTransfer(entry, manifest, err)
+	if errors.Is(err, file.ErrDeclined) {
+		log.Println("Declined the transfer")
+		return nil
+	}
+
+	return err
+}
+
+// receive creates a self-signed TLS certificate, waits for the sender at
+// senderAddr to connect, exchanges the certificate for the sender's, upgrades
+// the connection to TLS, and receives files, now that the handshake produced
+// the provided capabilities and session key. Every connection in the session is
+// accepted on the same TCP port. Returns the sender's manifest, if it arrived,
+// so that it can be recorded in the audit log.
+func (c *ReceiverConfig) receive(
+	senderAddr _net.Addr,
+	capabilities handshake.Capabilities,
+	sessionKey []byte,
+) (file.Manifest, error) {
+	localAddrs, err := net.GetLocalAddrs()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	certificate, err := cert.GenerateSelfSignedCert(localAddr)
+	certificate, err := cert.GenerateSelfSignedCert(localAddrs)
 	if err != nil {
-		return fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		return nil, fmt.Errorf("failed to generate self-signed certificate:"+
+			" %v", err)
 	}
-	if err = cert.SendToSender(
-		certificate,
-		c.port,
-		certTimeoutDuration,
-	); err != nil {
-		return fmt.Errorf("failed to send self-signed cert to sender: %v", err)
+	ln, err := net.CreateTCPListener(c.tcpPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TCP listener: %v", err)
+	}
+	defer ln.Close()
+	conn, senderCert, err := exchangeCerts(ln, senderAddr, certificate,
+		sessionKey)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
 
-	err = file.ReceiveFromSender(certificate, c.tlsPort, tlsTimeoutDuration)
+	var out io.Writer
+	if c.toStdout {
+		out = os.Stdout
+	}
+	capturer, err := input.NewCapturer("➜", "sender", os.Stdin, os.Stderr)
 	if err != nil {
-		return fmt.Errorf("failed to receive file from sender: %v", err)
+		return nil, fmt.Errorf("failed to prepare to ask for confirmation: %v",
+			err)
+	}
+	manifest, err := file.ReceiveFromSender(
+		ln,
+		conn,
+		certificate,
+		senderCert,
+		sessionKey,
+		tlsTimeoutDuration,
+		out,
+		capabilities.Has(handshake.CapabilityCompression),
+		capabilities.Has(handshake.CapabilityMultiStream),
+		capturer,
+	)
+	if err != nil && !errors.Is(err, file.ErrDeclined) {
+		err = fmt.Errorf("failed to receive file from sender: %v", err)
+	}
+
+	return manifest, err
+}
+
+// exchangeCerts accepts connections on the provided listener until the sender
+// at senderAddr connects and sends us its certificate, then sends it ours in
+// return. Anything else that connects to our port in the meantime is hung up
+// on, so that it can't get in the sender's way. Returns the connection, which
+// is ready to be upgraded to TLS, along with the sender's certificate.
+func exchangeCerts(
+	ln _net.Listener,
+	senderAddr _net.Addr,
+	certificate *cert.SelfSignedCert,
+	sessionKey []byte,
+) (_net.Conn, []byte, error) {
+	deadline := time.Now().Add(certTimeoutDuration * time.Second)
+	var exchangeErr error
+	for {
+		conn, err := net.AcceptFrom(ln, senderAddr, deadline)
+		if err != nil {
+			if exchangeErr != nil {
+				return nil, nil, fmt.Errorf("failed to exchange self-signed"+
+					" certs with sender: %v", exchangeErr)
+			}
+			return nil, nil, fmt.Errorf("sender never connected: %v", err)
+		}
+		senderCert, err := cert.ExchangeWithSender(
+			conn,
+			certificate,
+			sessionKey,
+			certTimeoutDuration,
+		)
+		if err == nil {
+			return conn, senderCert, nil
+		}
+		conn.Close()
+		exchangeErr = err
+	}
+}
+
+// receiverCapabilities returns the optional features that the receiver
+// supports. Files that are sent over several connections at once arrive out of
+// order, so they can't be written to stdout as they arrive.
+func receiverCapabilities(toStdout bool) handshake.Capabilities {
+	capabilities := handshake.SupportedCapabilities
+	if toStdout {
+		capabilities &^= handshake.CapabilityMultiStream
 	}
 
-	return nil
+	return capabilities
 }
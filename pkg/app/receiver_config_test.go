@@ -0,0 +1,25 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/nchaloult/lancp/pkg/handshake"
+)
+
+func TestReceiverCapabilities(t *testing.T) {
+	got := receiverCapabilities(false)
+	if got != handshake.SupportedCapabilities {
+		t.Fatalf("unexpected result, got: %b\nwant: %b", got,
+			handshake.SupportedCapabilities)
+	}
+
+	// Compressed files still arrive in order, so they can be written to
+	// stdout.
+	got = receiverCapabilities(true)
+	if got.Has(handshake.CapabilityMultiStream) {
+		t.Fatal("receiver writing to stdout supports multistream")
+	}
+	if !got.Has(handshake.CapabilityCompression) {
+		t.Fatal("receiver writing to stdout doesn't support compression")
+	}
+}
@@ -2,10 +2,16 @@ package app
 
 import (
 	"fmt"
+	_io "io"
+	"log"
+	_net "net"
+	"os"
 
+	"github.com/nchaloult/lancp/pkg/audit"
 	"github.com/nchaloult/lancp/pkg/cert"
 	"github.com/nchaloult/lancp/pkg/file"
 	"github.com/nchaloult/lancp/pkg/handshake"
+	"github.com/nchaloult/lancp/pkg/input"
 	"github.com/nchaloult/lancp/pkg/io"
 	"github.com/nchaloult/lancp/pkg/net"
 )
@@ -13,15 +19,63 @@ import (
 // SenderConfig stores input from command line arguments, as well as configs
 // that are set globally, for use when lancp is run with the "send" subcommand.
 type SenderConfig struct {
-	filePath string
-	port     string
-	tlsPort  string
+	filePaths []string
+
+	// port is the UDP port that the handshake takes place on, and tcpPort is
+	// the TCP port that everything after it does.
+	port    string
+	tcpPort string
+
+	// ifaceName is the name of the network interface that the user asked for
+	// the handshake to be broadcast on, or empty to broadcast on every one.
+	ifaceName string
+
+	// discovery is how receivers are found.
+	discovery handshake.Discovery
+
+	// host is the host name or IP address of the receiver that the user asked
+	// for the handshake to be sent straight to, or empty to find receivers
+	// with discovery.
+	host string
+
+	// compress is true if the user asked for files to be compressed before
+	// they're sent.
+	compress bool
+
+	// numStreams is the number of connections that the user asked for large
+	// files to be sent over at the same time.
+	numStreams int
 }
 
 // NewSenderConfig returns a pointer to a new SenderConfig struct initialized
-// with the provided arguments.
-func NewSenderConfig(filePath string, port, tlsPort int) (*SenderConfig, error) {
-	if err := io.IsFileAccessible(filePath); err != nil {
+// with the provided arguments. Any file paths that are glob patterns are
+// expanded. If ifaceName isn't empty, the handshake is only broadcast on the
+// network interface with that name. discovery is either "broadcast" or "mdns".
+// If host isn't empty, the handshake is sent straight to that host instead.
+func NewSenderConfig(
+	filePaths []string,
+	port, tcpPort int,
+	ifaceName, discovery, host string,
+	compress bool,
+	numStreams int,
+) (*SenderConfig, error) {
+	if numStreams < 1 || numStreams > file.MaxStreams {
+		return nil, fmt.Errorf("number of streams must be between 1 and %d,"+
+			" got %d", file.MaxStreams, numStreams)
+	}
+
+	if ifaceName != "" {
+		if err := net.ValidateInterface(ifaceName); err != nil {
+			return nil, err
+		}
+	}
+	parsedDiscovery, err := handshake.ParseDiscovery(discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	filePaths, err = io.ExpandPaths(filePaths)
+	if err != nil {
 		return nil, err
 	}
 
@@ -29,52 +83,150 @@ func NewSenderConfig(filePath string, port, tlsPort int) (*SenderConfig, error)
 	if err != nil {
 		return nil, err
 	}
-	tlsPortAsString, err := net.GetPortAsString(tlsPort)
+	tcpPortAsString, err := net.GetPortAsString(tcpPort)
 	if err != nil {
 		return nil, err
 	}
 
 	return &SenderConfig{
-		filePath: filePath,
-		port:     portAsString,
-		tlsPort:  tlsPortAsString,
+		filePaths:  filePaths,
+		port:       portAsString,
+		tcpPort:    tcpPortAsString,
+		ifaceName:  ifaceName,
+		discovery:  parsedDiscovery,
+		host:       host,
+		compress:   compress,
+		numStreams: numStreams,
 	}, nil
 }
 
 // Run executes appropriate procedures when lancp is run with the "send"
-// subcommand. It completes an initial passphrase handshake with a receiver,
-// receives a TLS certificate from that receiver, establishes a TLS connection
-// with that certificate, and sends a file.
+// subcommand. It builds a manifest of every file, completes an initial
+// handshake with a receiver, which only needs a passphrase if the two machines
+// aren't paired, creates a self-signed TLS certificate, exchanges it for the
+// receiver's, establishes a TLS connection with that receiver, and sends every
+// file. Every transfer that gets past the handshake is recorded in the audit
+// log, however it turns out.
 func (c *SenderConfig) Run() error {
+	// Hashing every file can take a while, so get it out of the way before
+	// anyone's waiting on us.
+	manifest, err := file.BuildManifest(c.filePaths...)
+	if err != nil {
+		return err
+	}
+
+	// If we're sending whatever is piped into stdin, then we can't read the
+	// user's input from there, too.
+	inputReader := _io.Reader(os.Stdin)
+	for _, filePath := range c.filePaths {
+		if filePath != io.StdinPath {
+			continue
+		}
+		terminal, err := input.OpenTerminal()
+		if err != nil {
+			return fmt.Errorf("failed to open terminal for user input: %v", err)
+		}
+		defer terminal.Close()
+		inputReader = terminal
+		break
+	}
+
+	var capabilities handshake.Capabilities
+	if c.compress {
+		capabilities |= handshake.CapabilityCompression
+	}
+	if c.numStreams > 1 {
+		capabilities |= handshake.CapabilityMultiStream
+	}
+	identity, knownDevices, err := loadPairedDevices()
+	if err != nil {
+		return err
+	}
 	conductor, err := handshake.NewSenderConductor(
 		c.port,
+		c.ifaceName,
+		c.discovery,
+		c.host,
 		handshakeTimeoutDuration,
+		inputReader,
+		capabilities,
+		identity,
+		knownDevices,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to prepare for the lancp handshake: %v", err)
 	}
-	receiverAddr, err := conductor.ConductHandshake()
+	receiverAddr, capabilities, sessionKey, err :=
+		conductor.ConductHandshake()
 	if err != nil {
 		return err
 	}
 
-	certificate, err := cert.ReceiveFromReceiver(
-		receiverAddr,
+	entry := newAuditEntry(audit.DirectionSend, receiverAddr,
+		conductor.PairedDevice())
+	err = c.send(receiverAddr, manifest, capabilities, sessionKey)
+	recordTransfer(entry, manifest, err)
+
+	return err
+}
+
+// send creates a self-signed TLS certificate, connects to the receiver at the
+// provided address, exchanges the certificate for the receiver's, upgrades the
+// connection to TLS, and sends every file in the provided manifest, now that
+// the handshake produced the provided capabilities and session key.
+func (c *SenderConfig) send(
+	receiverAddr _net.Addr,
+	manifest file.Manifest,
+	capabilities handshake.Capabilities,
+	sessionKey []byte,
+) error {
+	numStreams := 1
+	if capabilities.Has(handshake.CapabilityMultiStream) {
+		numStreams = c.numStreams
+	} else if c.numStreams > 1 {
+		log.Println("Receiver can't receive over several connections, so" +
+			" only one will be used")
+	}
+
+	localAddrs, err := net.GetLocalAddrs()
+	if err != nil {
+		return err
+	}
+	certificate, err := cert.GenerateSelfSignedCert(localAddrs)
+	if err != nil {
+		return fmt.Errorf("failed to generate self-signed certificate: %v", err)
+	}
+	conn, err := net.ConnectToTCPConn(
+		net.GetTCPAddress(receiverAddr.String(), c.tcpPort),
+		certTimeoutDuration,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to receiver: %v", err)
+	}
+	defer conn.Close()
+	receiverCert, err := cert.ExchangeWithReceiver(
+		conn,
+		certificate,
+		sessionKey,
 		certTimeoutDuration,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to get TLS certificate from receiver: %v",
-			err)
+		return fmt.Errorf("failed to exchange self-signed certs with"+
+			" receiver: %v", err)
 	}
 	err = file.SendToReceiver(
-		net.GetTLSAddress(receiverAddr.String(), c.tlsPort),
-		c.filePath,
+		conn,
+		manifest,
 		certificate,
+		receiverCert,
+		sessionKey,
+		capabilities.Has(handshake.CapabilityCompression),
+		numStreams,
 		tlsTimeoutDuration,
-		fileSendRetries,
+		confirmationTimeoutDuration,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to send file to receiver: %v", err)
+		return fmt.Errorf("failed to send files to receiver: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileName is the name of the file in the config directory that the audit log
+// is stored in.
+const fileName = "audit.log"
+
+// Directions that a transfer can go in, from this machine's point of view.
+const (
+	DirectionSend    = "send"
+	DirectionReceive = "receive"
+)
+
+// Outcomes that a transfer can have.
+const (
+	// OutcomeCompleted means that every file arrived intact.
+	OutcomeCompleted = "completed"
+
+	// OutcomeDeclined means that the user on this machine declined the
+	// transfer.
+	OutcomeDeclined = "declined"
+
+	// OutcomeFailed means that something went wrong. Entry.Error says what.
+	OutcomeFailed = "failed"
+)
+
+// Entry is one transfer in the audit log.
+type Entry struct {
+	// Time is when the transfer finished.
+	Time time.Time `json:"time"`
+
+	// Direction is DirectionSend or DirectionReceive.
+	Direction string `json:"direction"`
+
+	// PeerAddr is the address of the machine on the other end of the
+	// transfer.
+	PeerAddr string `json:"peer_addr"`
+
+	// PeerDevice and PeerKey are the name and base64-encoded public key of
+	// the paired device on the other end of the transfer. Both are empty if
+	// the handshake was authenticated with a passphrase instead.
+	PeerDevice string `json:"peer_device,omitempty"`
+	PeerKey    string `json:"peer_key,omitempty"`
+
+	// Files are the files that were sent, or that the sender tried to send.
+	Files []File `json:"files"`
+
+	// Outcome is one of OutcomeCompleted, OutcomeDeclined, or OutcomeFailed.
+	Outcome string `json:"outcome"`
+
+	// Error is what went wrong, if Outcome is OutcomeFailed.
+	Error string `json:"error,omitempty"`
+}
+
+// File is one file in a transfer.
+type File struct {
+	// Path is the file's path, relative to the directory that it was sent
+	// from, or saved in.
+	Path string `json:"path"`
+
+	// Size is the file's size in bytes, or -1 if it was read from a stream,
+	// and its size wasn't known ahead of time.
+	Size int64 `json:"size"`
+
+	// Digest is the hex-encoded SHA-256 digest of the file's contents. Empty if
+	// it was read from a stream.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Append adds the provided entry to the end of the audit log, which is stored
+// in the provided directory. Each entry is written with a single write to a
+// file that's opened for appending, so entries from lancp processes that finish
+// at the same time don't get mixed together.
+func Append(dir string, entry *Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit log entry: %v", err)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fileName),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write to audit log: %v", err)
+	}
+
+	return nil
+}
+
+// Read returns every entry in the audit log, which is stored in the provided
+// directory, from oldest to newest. If there isn't an audit log there yet, it
+// returns no entries.
+func Read(dir string) ([]Entry, error) {
+	f, err := os.Open(filepath.Join(dir, fileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	// Transfers of lots of files make for long lines.
+	scanner.Buffer(nil, 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", f.Name(), lineNum, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAppendAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := Read(dir)
+	if err != nil {
+		t.Fatalf("unexpected error reading empty audit log: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no entries, got %d", len(entries))
+	}
+
+	want := []Entry{
+		{
+			Time:       time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+			Direction:  DirectionSend,
+			PeerAddr:   "192.168.1.20:6969",
+			PeerDevice: "desktop",
+			PeerKey:    "bm90IGEga2V5",
+			Files:      []File{{"notes.txt", 12, "ab12"}},
+			Outcome:    OutcomeCompleted,
+		},
+		{
+			Time:      time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC),
+			Direction: DirectionReceive,
+			PeerAddr:  "192.168.1.30:6969",
+			Files:     []File{{"stdin", -1, ""}},
+			Outcome:   OutcomeFailed,
+			Error:     "connection reset",
+		},
+	}
+	for i := range want {
+		if err = Append(dir, &want[i]); err != nil {
+			t.Fatalf("unexpected error appending entry: %v", err)
+		}
+	}
+
+	got, err := Read(dir)
+	if err != nil {
+		t.Fatalf("unexpected error reading audit log: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected entries, got: %+v\nwant: %+v", got, want)
+	}
+	info, err := os.Stat(filepath.Join(dir, fileName))
+	if err != nil {
+		t.Fatalf("unexpected error checking audit log: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Fatalf("expected only the user to be able to read the audit log,"+
+			" got mode %v", perm)
+	}
+}
+
+func TestQueryMatches(t *testing.T) {
+	entry := &Entry{
+		Time:       time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC),
+		Direction:  DirectionSend,
+		PeerAddr:   "192.168.1.20:6969",
+		PeerDevice: "Desktop",
+		Files:      []File{{"photos/beach.jpg", 12, "ab12"}},
+		Outcome:    OutcomeCompleted,
+	}
+
+	for name, tc := range map[string]struct {
+		query Query
+		want  bool
+	}{
+		"empty":         {Query{}, true},
+		"peer address":  {Query{Peer: "1.20"}, true},
+		"peer device":   {Query{Peer: "desktop"}, true},
+		"other peer":    {Query{Peer: "laptop"}, false},
+		"file":          {Query{File: "BEACH"}, true},
+		"other file":    {Query{File: "mountain"}, false},
+		"since before":  {Query{Since: entry.Time.Add(-time.Hour)}, true},
+		"since after":   {Query{Since: entry.Time.Add(time.Hour)}, false},
+		"outcome":       {Query{Outcome: OutcomeCompleted}, true},
+		"other outcome": {Query{Outcome: OutcomeFailed}, false},
+		"everything": {
+			Query{"desktop", "beach", entry.Time, OutcomeCompleted},
+			true,
+		},
+		"all but one": {
+			Query{"desktop", "beach", entry.Time, OutcomeFailed},
+			false,
+		},
+	} {
+		if got := tc.query.Matches(entry); got != tc.want {
+			t.Fatalf("%s: unexpected match, got: %t\nwant: %t", name, got,
+				tc.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"strings"
+	"time"
+)
+
+// Query picks out entries in the audit log. Every field that isn't its zero
+// value must match for an entry to match.
+type Query struct {
+	// Peer matches entries whose peer address, paired device name, or paired
+	// device public key has it in them, ignoring case.
+	Peer string
+
+	// File matches entries with a file whose path has it in it, ignoring case.
+	File string
+
+	// Since matches entries that were recorded at or after it.
+	Since time.Time
+
+	// Outcome matches entries with exactly this outcome.
+	Outcome string
+}
+
+// Matches returns true if the provided entry matches the query.
+func (q *Query) Matches(entry *Entry) bool {
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if q.Outcome != "" && entry.Outcome != q.Outcome {
+		return false
+	}
+	if q.Peer != "" && !containsFold(entry.PeerAddr, q.Peer) &&
+		!containsFold(entry.PeerDevice, q.Peer) &&
+		!containsFold(entry.PeerKey, q.Peer) {
+		return false
+	}
+	if q.File != "" {
+		for _, f := range entry.Files {
+			if containsFold(f.Path, q.File) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// containsFold returns true if substr is in s, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
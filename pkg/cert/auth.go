@@ -0,0 +1,78 @@
+package cert
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+)
+
+// senderMACLabel and receiverMACLabel are mixed into the MACs of the sender's
+// and receiver's certificates, respectively, so that neither can be mistaken
+// for a MAC of anything else.
+const (
+	senderMACLabel   = "lancp sender certificate"
+	receiverMACLabel = "lancp receiver certificate"
+)
+
+// errUnauthenticated is returned when a certificate's MAC doesn't match.
+var errUnauthenticated = errors.New("certificate didn't come from the machine" +
+	" that completed the handshake")
+
+// fingerprint returns the SHA-256 digest of the DER-encoded certificate in the
+// provided PEM-encoded bytes.
+func fingerprint(certPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode PEM-encoded certificate")
+	}
+	digest := sha256.Sum256(block.Bytes)
+
+	return digest[:], nil
+}
+
+// computeMAC returns a MAC of the fingerprint of the certificate in the
+// provided PEM-encoded bytes, keyed with the secret key that the handshake
+// produced. Only the machines that completed the handshake can compute it.
+//
+// label says whose certificate it is.
+func computeMAC(certPEM, sessionKey []byte, label string) ([]byte, error) {
+	digest, err := fingerprint(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(label))
+	mac.Write(digest)
+
+	return mac.Sum(nil), nil
+}
+
+// attachMAC returns the provided PEM-encoded certificate, preceded by its MAC.
+// See computeMAC.
+func attachMAC(certPEM, sessionKey []byte, label string) ([]byte, error) {
+	mac, err := computeMAC(certPEM, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(mac, certPEM...), nil
+}
+
+// verifyMAC checks the MAC that precedes the PEM-encoded certificate in the
+// provided message, and returns the certificate if it matches. See computeMAC.
+func verifyMAC(message, sessionKey []byte, label string) ([]byte, error) {
+	if len(message) < sha256.Size {
+		return nil, errors.New("message is too short to have a MAC")
+	}
+	mac, certPEM := message[:sha256.Size], message[sha256.Size:]
+	want, err := computeMAC(certPEM, sessionKey, label)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, want) {
+		return nil, errUnauthenticated
+	}
+
+	return certPEM, nil
+}
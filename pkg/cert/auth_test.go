@@ -0,0 +1,63 @@
+package cert
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestMACRoundTrip(t *testing.T) {
+	certificate, err := GenerateSelfSignedCert(
+		[]net.IP{net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	key := []byte("session key")
+	message, err := attachMAC(certificate.Bytes, key, receiverMACLabel)
+	if err != nil {
+		t.Fatalf("unexpected error attaching MAC: %v", err)
+	}
+
+	got, err := verifyMAC(message, key, receiverMACLabel)
+	if err != nil {
+		t.Fatalf("unexpected error verifying MAC: %v", err)
+	}
+	if !bytes.Equal(got, certificate.Bytes) {
+		t.Fatalf("unexpected certificate, got: %q\nwant: %q", got,
+			certificate.Bytes)
+	}
+}
+
+func TestVerifyMACRejectsOtherCertificate(t *testing.T) {
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	certificate, err := GenerateSelfSignedCert(ips)
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	other, err := GenerateSelfSignedCert(ips)
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	key := []byte("session key")
+	message, err := attachMAC(certificate.Bytes, key, receiverMACLabel)
+	if err != nil {
+		t.Fatalf("unexpected error attaching MAC: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		message []byte
+		key     []byte
+	}{
+		"swapped certificate": {
+			append(message[:32:32], other.Bytes...),
+			key,
+		},
+		"wrong key": {message, []byte("other key")},
+		"too short": {message[:16], key},
+	} {
+		if _, err := verifyMAC(tc.message, tc.key,
+			receiverMACLabel); err == nil {
+			t.Fatalf("%s: expected an error verifying MAC", name)
+		}
+	}
+}
@@ -1,44 +1,87 @@
 package cert
 
 import (
+	"fmt"
 	_net "net"
+	"time"
 
 	"github.com/nchaloult/lancp/pkg/net"
 )
 
-// ReceiveFromReceiver gets a TLS certificate from the receiver at the provided
-// address through a TCP connection.
+// ExchangeWithReceiver sends our TLS certificate to the receiver along the
+// provided connection, which was just established with it, and gets the
+// receiver's TLS certificate in return. Both certificates are sent in
+// certificate frames with a MAC keyed with the secret key that the handshake
+// produced, and the receiver's certificate is only returned if its MAC matches,
+// so that nobody can swap either of them out for their own along the way.
+//
+// Nothing else is read from the connection, so it can be upgraded to TLS
+// afterwards.
 //
 // timeoutDuration is in seconds.
-func ReceiveFromReceiver(addr _net.Addr, timeoutDuration uint) ([]byte, error) {
-	conn, err := net.ConnectToTCPConn(addr, timeoutDuration)
+func ExchangeWithReceiver(
+	conn _net.Conn,
+	certificate *SelfSignedCert,
+	sessionKey []byte,
+	timeoutDuration uint,
+) ([]byte, error) {
+	message, err := attachMAC(certificate.Bytes, sessionKey, senderMACLabel)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(
+		time.Duration(timeoutDuration) * time.Second))
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer conn.SetDeadline(time.Time{})
+
+	if err = net.WriteFrame(conn, net.FrameCertificate, message); err != nil {
+		return nil, fmt.Errorf("failed to send certificate: %v", err)
+	}
+	frame, err := net.NewFrameReader(conn).ExpectFrame(net.FrameCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive certificate: %v", err)
+	}
 
-	return net.ReceiveMessage(conn, timeoutDuration)
+	return verifyMAC(frame.Payload, sessionKey, receiverMACLabel)
 }
 
-// SendToSender establishes a TCP connection with the sender and sends a TLS
-// certificate.
+// ExchangeWithSender waits for the sender to send us its TLS certificate along
+// the provided connection, which it just established with us, then sends it our
+// TLS certificate in return. See ExchangeWithReceiver for how they're
+// authenticated. The sender's certificate is only returned, and ours is only
+// sent, if the sender's MAC matches.
 //
 // timeoutDuration is in seconds.
-func SendToSender(
+func ExchangeWithSender(
+	conn _net.Conn,
 	certificate *SelfSignedCert,
-	port string,
+	sessionKey []byte,
 	timeoutDuration uint,
-) error {
-	ln, err := net.CreateTCPListener(port)
+) ([]byte, error) {
+	message, err := attachMAC(certificate.Bytes, sessionKey, receiverMACLabel)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer ln.Close()
-	conn, err := net.EstablishConn(ln, timeoutDuration)
+	err = conn.SetDeadline(time.Now().Add(
+		time.Duration(timeoutDuration) * time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	frame, err := net.NewFrameReader(conn).ExpectFrame(net.FrameCertificate)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to receive certificate: %v", err)
+	}
+	senderCert, err := verifyMAC(frame.Payload, sessionKey, senderMACLabel)
+	if err != nil {
+		return nil, err
+	}
+	if err = net.WriteFrame(conn, net.FrameCertificate, message); err != nil {
+		return nil, fmt.Errorf("failed to send certificate: %v", err)
 	}
-	defer conn.Close()
 
-	return net.SendMessage(certificate.Bytes, conn)
+	return senderCert, nil
 }
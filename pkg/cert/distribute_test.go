@@ -0,0 +1,63 @@
+package cert
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+	senderCert, err := GenerateSelfSignedCert(ips)
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	receiverCert, err := GenerateSelfSignedCert(ips)
+	if err != nil {
+		t.Fatalf("unexpected error generating certificate: %v", err)
+	}
+	key := []byte("session key")
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+
+	type result struct {
+		cert []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		got, err := ExchangeWithSender(receiverConn, receiverCert, key, 3)
+		results <- result{got, err}
+		// Whatever comes after the certificates is left for TLS.
+		if err == nil {
+			receiverConn.Write([]byte("TLS"))
+		}
+	}()
+
+	got, err := ExchangeWithReceiver(senderConn, senderCert, key, 3)
+	if err != nil {
+		t.Fatalf("unexpected error exchanging with receiver: %v", err)
+	}
+	if !bytes.Equal(got, receiverCert.Bytes) {
+		t.Fatalf("unexpected receiver certificate, got: %q\nwant: %q", got,
+			receiverCert.Bytes)
+	}
+	res := <-results
+	if res.err != nil {
+		t.Fatalf("unexpected error exchanging with sender: %v", res.err)
+	}
+	if !bytes.Equal(res.cert, senderCert.Bytes) {
+		t.Fatalf("unexpected sender certificate, got: %q\nwant: %q", res.cert,
+			senderCert.Bytes)
+	}
+	rest := make([]byte, 3)
+	if _, err = io.ReadFull(senderConn, rest); err != nil {
+		t.Fatalf("unexpected error reading after exchange: %v", err)
+	}
+	if string(rest) != "TLS" {
+		t.Fatalf("unexpected bytes after exchange, got: %q\nwant: %q", rest,
+			"TLS")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
@@ -26,42 +27,69 @@ type SelfSignedCert struct {
 
 // GetReceiverTLSConfig builds a tls.Config object for the receiver to use when
 // establishing a TLS connection with the sender. It adds the receiver's public/
-// private key pair to the config's list of certificates.
-func GetReceiverTLSConfig(cert *SelfSignedCert) (*tls.Config, error) {
+// private key pair to the config's list of certificates, and requires the
+// sender to present the certificate that it sent us.
+func GetReceiverTLSConfig(
+	cert *SelfSignedCert,
+	senderCertPEM []byte,
+) (*tls.Config, error) {
 	keyPair, err := tls.X509KeyPair(cert.Bytes, cert.SK)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create x509 public/private key pair"+
 			" from the provided self-signed certificate: %v", err)
 	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(senderCertPEM) {
+		return nil, errors.New("failed to parse sender's certificate")
+	}
 
 	return &tls.Config{
 		Certificates: []tls.Certificate{keyPair},
+		ClientCAs:    certPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
 	}, nil
 }
 
 // GetSenderTLSConfig builds a tls.Config object for the sender to use when
-// establishing a TLS connection with the receiver. It adds the public key of
-// the certificate authority that the receiver created to the config's
-// collection of trusted certificate authorities.
-func GetSenderTLSConfig(certPEM []byte) *tls.Config {
+// establishing a TLS connection with the receiver. It adds the sender's public/
+// private key pair to the config's list of certificates, so that it can prove
+// who it is to the receiver, and adds the public key of the certificate
+// authority that the receiver created to the config's collection of trusted
+// certificate authorities.
+func GetSenderTLSConfig(
+	cert *SelfSignedCert,
+	receiverCertPEM []byte,
+) (*tls.Config, error) {
+	keyPair, err := tls.X509KeyPair(cert.Bytes, cert.SK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create x509 public/private key pair"+
+			" from the provided self-signed certificate: %v", err)
+	}
 	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(certPEM)
+	if !certPool.AppendCertsFromPEM(receiverCertPEM) {
+		return nil, errors.New("failed to parse receiver's certificate")
+	}
 
 	return &tls.Config{
-		RootCAs: certPool,
-	}
+		Certificates: []tls.Certificate{keyPair},
+		RootCAs:      certPool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
 }
 
 // GenerateSelfSignedCert creates a self-signed x509 certificate to be used when
-// establishing a TLS connection with the sender. The created certificate is
-// valid for the device with the provided IPv4 address.
+// establishing a TLS connection with the other machine. The created certificate
+// is valid for the device with the provided IPv4 and IPv6 addresses. Both the
+// sender and receiver generate one, since they each prove who they are to the
+// other.
 //
 // It generates a public/private key pair, uses those keys to build an x509
-// certificate, self-signs that certificate so the sender will trust it, and
-// PEM-encodes that certificate and private key.
+// certificate, self-signs that certificate so the other machine will trust it,
+// and PEM-encodes that certificate and private key.
 //
 // Inspired by https://golang.org/src/crypto/tls/generate_cert.go
-func GenerateSelfSignedCert(ip net.IP) (*SelfSignedCert, error) {
+func GenerateSelfSignedCert(ips []net.IP) (*SelfSignedCert, error) {
 	// Get public/private key pair for certificate.
 	_, sk, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -79,7 +107,7 @@ func GenerateSelfSignedCert(ip net.IP) (*SelfSignedCert, error) {
 
 	// Build a certificate template.
 	certTemplate := x509.Certificate{
-		IPAddresses: []net.IP{ip},
+		IPAddresses: ips,
 
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
@@ -96,7 +124,10 @@ func GenerateSelfSignedCert(ip net.IP) (*SelfSignedCert, error) {
 
 		KeyUsage: x509.KeyUsageDigitalSignature,
 
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
 		BasicConstraintsValid: true,
 	}
 
@@ -0,0 +1,124 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// identityFileName is the name of the file in the config directory that this
+// machine's identity is stored in.
+const identityFileName = "identity.pem"
+
+// Identity is this machine's long-lived identity. Devices that it's paired
+// with recognize it by its public key, so that transfers between them don't
+// need a passphrase.
+type Identity struct {
+	// Name is what paired devices call this machine. It's only a label, and
+	// isn't used to recognize it.
+	Name string
+
+	// PublicKey is what paired devices recognize this machine by.
+	PublicKey ed25519.PublicKey
+
+	privateKey ed25519.PrivateKey
+}
+
+// ConfigDir returns the directory that lancp stores this machine's identity,
+// and the devices that it's paired with, in.
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "lancp"), nil
+}
+
+// LoadIdentity returns this machine's identity, which is stored in the provided
+// directory. If it doesn't have one yet, a new one is created and stored there.
+func LoadIdentity(dir string) (*Identity, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get this machine's name: %v", err)
+	}
+	identityPath := filepath.Join(dir, identityFileName)
+	privateKeyPEM, err := ioutil.ReadFile(identityPath)
+	if os.IsNotExist(err) {
+		return createIdentity(identityPath, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %v", err)
+	}
+
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("failed to decode PEM-encoded identity in %s",
+			identityPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity in %s: %v",
+			identityPath, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity in %s isn't an Ed25519 key",
+			identityPath)
+	}
+
+	return &Identity{
+		name,
+		privateKey.Public().(ed25519.PublicKey),
+		privateKey,
+	}, nil
+}
+
+// createIdentity creates a new identity with the provided name, and stores it
+// at the provided path. Only the user who runs lancp can read it.
+func createIdentity(identityPath, name string) (*Identity, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity: %v", err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})
+	if privateKeyPEM == nil {
+		return nil, errors.New("failed to PEM-encode identity")
+	}
+
+	if err = os.MkdirAll(filepath.Dir(identityPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %v", err)
+	}
+	// O_EXCL makes sure that we never overwrite an identity that's already
+	// paired with other devices.
+	f, err := os.OpenFile(identityPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store identity: %v", err)
+	}
+	defer f.Close()
+	if _, err = f.Write(privateKeyPEM); err != nil {
+		return nil, fmt.Errorf("failed to store identity: %v", err)
+	}
+
+	return &Identity{name, publicKey, privateKey}, nil
+}
+
+// Sign returns a signature of the provided message with this machine's
+// identity, which can be checked against its public key.
+func (i *Identity) Sign(message []byte) []byte {
+	return ed25519.Sign(i.privateKey, message)
+}
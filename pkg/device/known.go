@@ -0,0 +1,156 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const (
+	// knownDevicesFileName is the name of the file in the config directory
+	// that the devices that this machine is paired with are stored in.
+	knownDevicesFileName = "known_devices"
+
+	// maxNameLen is the length that device names are cut down to.
+	maxNameLen = 64
+)
+
+// Device is a device that this machine is paired with.
+type Device struct {
+	// Name is what the device calls itself.
+	Name string
+
+	// PublicKey is what the device is recognized by.
+	PublicKey ed25519.PublicKey
+}
+
+// KnownDevices is the list of devices that this machine is paired with.
+//
+// It's stored in a text file, with one device per line. Each line is the
+// device's public key in base64, then a space, then the device's name. Blank
+// lines and lines that begin with "#" are ignored, so the file can be edited
+// by hand, like to remove a device.
+type KnownDevices struct {
+	// path is where the list is stored.
+	path string
+
+	devices []Device
+}
+
+// LoadKnownDevices returns the list of devices that this machine is paired
+// with, which is stored in the provided directory. If there isn't a list there
+// yet, the returned one is empty.
+func LoadKnownDevices(dir string) (*KnownDevices, error) {
+	k := &KnownDevices{path: filepath.Join(dir, knownDevicesFileName)}
+	f, err := os.Open(k.path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known devices: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		publicKey, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s:%d: invalid public key", k.path,
+				lineNum)
+		}
+		name := ""
+		if len(fields) == 2 {
+			name = CleanName(fields[1])
+		}
+		k.devices = append(k.devices, Device{name, publicKey})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read known devices: %v", err)
+	}
+
+	return k, nil
+}
+
+// Len returns the number of devices that this machine is paired with.
+func (k *KnownDevices) Len() int {
+	return len(k.devices)
+}
+
+// Lookup returns the device with the provided public key, and true if this
+// machine is paired with it.
+func (k *KnownDevices) Lookup(publicKey []byte) (*Device, bool) {
+	for i := range k.devices {
+		if bytes.Equal(k.devices[i].PublicKey, publicKey) {
+			return &k.devices[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Add pairs this machine with the provided device, and stores the updated list.
+// If it's already paired with a device with the same public key, that device
+// is renamed instead.
+func (k *KnownDevices) Add(d Device) error {
+	if existing, ok := k.Lookup(d.PublicKey); ok {
+		existing.Name = d.Name
+	} else {
+		k.devices = append(k.devices, d)
+	}
+
+	var buf bytes.Buffer
+	for _, d := range k.devices {
+		fmt.Fprintf(&buf, "%s %s\n",
+			base64.StdEncoding.EncodeToString(d.PublicKey), d.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %v", err)
+	}
+	// Write the whole list to a temporary file first, so that it's never
+	// left half-written.
+	tmpPath := k.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to store known devices: %v", err)
+	}
+	if err := os.Rename(tmpPath, k.path); err != nil {
+		return fmt.Errorf("failed to store known devices: %v", err)
+	}
+
+	return nil
+}
+
+// CleanName returns the provided device name, without anything that could
+// mess with a terminal or the known devices file, and cut down to a reasonable
+// length. Devices choose their own names, so they can't be trusted.
+func CleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case !unicode.IsPrint(r):
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxNameLen {
+		name = string(runes[:maxNameLen])
+	}
+	if name == "" {
+		return "unnamed device"
+	}
+
+	return name
+}
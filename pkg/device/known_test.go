@@ -0,0 +1,127 @@
+package device
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	created, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+	loaded, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("unexpected error loading identity: %v", err)
+	}
+	if !bytes.Equal(loaded.PublicKey, created.PublicKey) {
+		t.Fatal("expected the same identity to be loaded as was created")
+	}
+	info, err := os.Stat(filepath.Join(dir, identityFileName))
+	if err != nil {
+		t.Fatalf("unexpected error checking identity file: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Fatalf("expected only the user to be able to read the identity,"+
+			" got mode %v", perm)
+	}
+}
+
+func TestKnownDevicesRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	laptop, err := LoadIdentity(filepath.Join(dir, "laptop"))
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+	desktop, err := LoadIdentity(filepath.Join(dir, "desktop"))
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+
+	known, err := LoadKnownDevices(dir)
+	if err != nil {
+		t.Fatalf("unexpected error loading known devices: %v", err)
+	}
+	if known.Len() != 0 {
+		t.Fatalf("expected no known devices, got %d", known.Len())
+	}
+	if err = known.Add(Device{"laptop", laptop.PublicKey}); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	if err = known.Add(Device{"desktop", desktop.PublicKey}); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+	// Pairing with the same device again only renames it.
+	if err = known.Add(Device{"old laptop", laptop.PublicKey}); err != nil {
+		t.Fatalf("unexpected error adding device: %v", err)
+	}
+
+	known, err = LoadKnownDevices(dir)
+	if err != nil {
+		t.Fatalf("unexpected error loading known devices: %v", err)
+	}
+	if known.Len() != 2 {
+		t.Fatalf("expected 2 known devices, got %d", known.Len())
+	}
+	d, ok := known.Lookup(laptop.PublicKey)
+	if !ok {
+		t.Fatal("expected the laptop to be known")
+	}
+	if d.Name != "old laptop" {
+		t.Fatalf("unexpected name, got: %q\nwant: %q", d.Name, "old laptop")
+	}
+	if _, ok = known.Lookup(make([]byte, len(laptop.PublicKey))); ok {
+		t.Fatal("expected an unknown public key not to be known")
+	}
+}
+
+func TestLoadKnownDevicesRejectsInvalidKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	contents := []byte("# paired devices\n\nbm90IGEga2V5 laptop\n")
+	err = ioutil.WriteFile(filepath.Join(dir, knownDevicesFileName),
+		contents, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error writing known devices: %v", err)
+	}
+
+	if _, err = LoadKnownDevices(dir); err == nil {
+		t.Fatal("expected an error loading a known devices file with an" +
+			" invalid key")
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"laptop", "laptop"},
+		{"  my\tlaptop\n", "my laptop"},
+		{"evil\x1b[2Jlaptop", "evil[2Jlaptop"},
+		{"", "unnamed device"},
+		{string(bytes.Repeat([]byte("a"), 100)),
+			string(bytes.Repeat([]byte("a"), maxNameLen))},
+	} {
+		if got := CleanName(tc.name); got != tc.want {
+			t.Fatalf("unexpected name for %q, got: %q\nwant: %q", tc.name, got,
+				tc.want)
+		}
+	}
+}
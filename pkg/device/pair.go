@@ -0,0 +1,197 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	_net "net"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// senderMACLabel and receiverMACLabel are mixed into the MACs of the
+// identities that the machine that typed in the passphrase and the machine that
+// displayed it send, respectively, so that neither can be mistaken for a MAC of
+// anything else.
+const (
+	senderMACLabel   = "lancp sender device"
+	receiverMACLabel = "lancp receiver device"
+)
+
+// errUnauthenticated is returned when an identity's MAC doesn't match.
+var errUnauthenticated = errors.New("identity didn't come from the machine" +
+	" that completed the handshake")
+
+// PairWithReceiver establishes a TCP connection with the machine at the
+// provided address, which displayed the passphrase that we typed in during the
+// handshake, sends it our identity, and gets its identity in return. Both
+// identities are sent in identity frames, right after the preamble, with a MAC
+// keyed with the secret key that the handshake produced, and the other machine
+// is only returned if its MAC matches, so that nobody can swap either of them
+// out for their own along the way.
+//
+// timeoutDuration is in seconds.
+func PairWithReceiver(
+	addr string,
+	identity *Identity,
+	sessionKey []byte,
+	timeoutDuration uint,
+) (*Device, error) {
+	conn, err := net.ConnectToTCPConn(addr, timeoutDuration)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(
+		time.Duration(timeoutDuration) * time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = net.WritePreamble(conn); err != nil {
+		return nil, err
+	}
+	message := attachMAC(identity, sessionKey, senderMACLabel)
+	if err = net.WriteFrame(conn, net.FrameIdentity, message); err != nil {
+		return nil, fmt.Errorf("failed to send identity: %v", err)
+	}
+
+	if err = net.ReadPreamble(conn); err != nil {
+		return nil, err
+	}
+	frame, err := net.NewFrameReader(conn).ExpectFrame(net.FrameIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive identity: %v", err)
+	}
+
+	return verifyMAC(frame.Payload, sessionKey, receiverMACLabel)
+}
+
+// PairWithSender waits for the machine at senderAddr, which typed in our
+// passphrase during the handshake, to establish a TCP connection and send us
+// its identity, then sends it our identity in return. See PairWithReceiver for
+// how they're authenticated. The other machine is only returned, and our
+// identity is only sent, if its MAC matches. If it doesn't, the other machine
+// is sent an error frame instead.
+//
+// Connections from anywhere else are hung up on, and so are connections that
+// don't send a valid identity, until one does or the timeout passes.
+//
+// timeoutDuration is in seconds.
+func PairWithSender(
+	identity *Identity,
+	sessionKey []byte,
+	port string,
+	senderAddr _net.Addr,
+	timeoutDuration uint,
+) (*Device, error) {
+	ln, err := net.CreateTCPListener(port)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	deadline := time.Now().Add(time.Duration(timeoutDuration) * time.Second)
+	var exchangeErr error
+	for {
+		conn, err := net.AcceptFrom(ln, senderAddr, deadline)
+		if err != nil {
+			if exchangeErr != nil {
+				return nil, exchangeErr
+			}
+			return nil, err
+		}
+		sender, err := exchangeWithSender(conn, identity, sessionKey,
+			deadline)
+		conn.Close()
+		if err == nil {
+			return sender, nil
+		}
+		exchangeErr = err
+	}
+}
+
+// exchangeWithSender carries out PairWithSender's side of pairing over the
+// provided connection, and gives up once deadline passes.
+func exchangeWithSender(
+	conn _net.Conn,
+	identity *Identity,
+	sessionKey []byte,
+	deadline time.Time,
+) (*Device, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// Our preamble is sent first, even if something goes wrong, so that the
+	// other machine can make sense of an error frame.
+	if err := net.WritePreamble(conn); err != nil {
+		return nil, err
+	}
+	if err := net.ReadPreamble(conn); err != nil {
+		return nil, err
+	}
+	frame, err := net.NewFrameReader(conn).ExpectFrame(net.FrameIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive identity: %v", err)
+	}
+	sender, err := verifyMAC(frame.Payload, sessionKey, senderMACLabel)
+	if err != nil {
+		net.WriteFrame(conn, net.FrameError, []byte(err.Error()))
+		return nil, err
+	}
+	message := attachMAC(identity, sessionKey, receiverMACLabel)
+	if err = net.WriteFrame(conn, net.FrameIdentity, message); err != nil {
+		return nil, fmt.Errorf("failed to send identity: %v", err)
+	}
+
+	return sender, nil
+}
+
+// computeMAC returns a MAC of the provided public key and name, keyed with the
+// secret key that the handshake produced. Only the machines that completed the
+// handshake can compute it.
+//
+// label says whose identity it is.
+func computeMAC(
+	publicKey []byte,
+	name string,
+	sessionKey []byte,
+	label string,
+) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(label))
+	mac.Write(publicKey)
+	mac.Write([]byte(name))
+
+	return mac.Sum(nil)
+}
+
+// attachMAC encodes the provided identity's public key and name, preceded by
+// their MAC. See computeMAC.
+func attachMAC(identity *Identity, sessionKey []byte, label string) []byte {
+	message := computeMAC(identity.PublicKey, identity.Name, sessionKey, label)
+	message = append(message, identity.PublicKey...)
+
+	return append(message, identity.Name...)
+}
+
+// verifyMAC checks the MAC that precedes the public key and name in the
+// provided message, and returns the device that they belong to if it matches.
+// See computeMAC.
+func verifyMAC(message, sessionKey []byte, label string) (*Device, error) {
+	if len(message) < sha256.Size+ed25519.PublicKeySize {
+		return nil, errors.New("message is too short to have an identity")
+	}
+	mac := message[:sha256.Size]
+	publicKey := message[sha256.Size : sha256.Size+ed25519.PublicKeySize]
+	name := string(message[sha256.Size+ed25519.PublicKeySize:])
+	if !hmac.Equal(mac, computeMAC(publicKey, name, sessionKey, label)) {
+		return nil, errUnauthenticated
+	}
+
+	return &Device{CleanName(name), ed25519.PublicKey(publicKey)}, nil
+}
@@ -0,0 +1,234 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	_net "net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+func TestIdentityMACRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	identity, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+	key := []byte("session key")
+	message := attachMAC(identity, key, senderMACLabel)
+
+	got, err := verifyMAC(message, key, senderMACLabel)
+	if err != nil {
+		t.Fatalf("unexpected error verifying MAC: %v", err)
+	}
+	if !bytes.Equal(got.PublicKey, identity.PublicKey) {
+		t.Fatal("unexpected public key")
+	}
+	if got.Name != CleanName(identity.Name) {
+		t.Fatalf("unexpected name, got: %q\nwant: %q", got.Name,
+			CleanName(identity.Name))
+	}
+
+	for name, tc := range map[string]struct {
+		message []byte
+		key     []byte
+		label   string
+	}{
+		"wrong key":   {message, []byte("other key"), senderMACLabel},
+		"wrong label": {message, key, receiverMACLabel},
+		"renamed": {
+			append(append([]byte{}, message...), "!"...),
+			key,
+			senderMACLabel,
+		},
+		"truncated": {message[:40], key, senderMACLabel},
+	} {
+		if _, err := verifyMAC(tc.message, tc.key, tc.label); err == nil {
+			t.Fatalf("%s: expected an error verifying MAC", name)
+		}
+	}
+}
+
+// pairing describes a pairing between two machines that are both run by pair.
+type pairing struct {
+	sender, receiver       *Identity
+	senderKey, receiverKey []byte
+
+	// senderIP is where the receiver expects the sender to connect from. If
+	// it's empty, it's 127.0.0.1, where the sender really connects from.
+	senderIP string
+
+	// strangers is the number of connections that are made to the receiver's
+	// port from 127.0.0.1 before the sender's, which each send it a frame that
+	// it doesn't expect.
+	strangers int
+}
+
+// pair runs both sides of the provided pairing over loopback, and returns what
+// each side got.
+func pair(
+	t *testing.T,
+	p pairing,
+) (gotReceiver, gotSender *Device, sendErr, recvErr error) {
+	t.Helper()
+	ln, err := _net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error finding a free port: %v", err)
+	}
+	_, port, _ := _net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	senderIP := p.senderIP
+	if senderIP == "" {
+		senderIP = "127.0.0.1"
+	}
+
+	type result struct {
+		device *Device
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		device, err := PairWithSender(p.receiver, p.receiverKey, ":"+port,
+			&_net.UDPAddr{IP: _net.ParseIP(senderIP)}, 1)
+		results <- result{device, err}
+	}()
+	// Everything that connects tries again until the receiver starts
+	// listening.
+	addr := _net.JoinHostPort("127.0.0.1", port)
+	for i := 0; i < p.strangers; i++ {
+		var stranger _net.Conn
+		for j := 0; j < 100; j++ {
+			if stranger, err = _net.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error connecting to receiver: %v", err)
+		}
+		defer stranger.Close()
+		net.WritePreamble(stranger)
+		net.WriteFrame(stranger, net.FrameHello, []byte("stranger"))
+	}
+	for i := 0; i < 100; i++ {
+		gotReceiver, sendErr = PairWithReceiver(addr, p.sender, p.senderKey,
+			1)
+		var opErr *_net.OpError
+		if !errors.As(sendErr, &opErr) || opErr.Op != "dial" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	res := <-results
+
+	return gotReceiver, res.device, sendErr, res.err
+}
+
+func loadTestIdentity(t *testing.T) *Identity {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	identity, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+
+	return identity
+}
+
+func TestPair(t *testing.T) {
+	sender, receiver := loadTestIdentity(t), loadTestIdentity(t)
+	key := []byte("session key")
+	gotReceiver, gotSender, sendErr, recvErr := pair(t, pairing{
+		sender:      sender,
+		receiver:    receiver,
+		senderKey:   key,
+		receiverKey: key,
+	})
+	if sendErr != nil {
+		t.Fatalf("unexpected error pairing with receiver: %v", sendErr)
+	}
+	if recvErr != nil {
+		t.Fatalf("unexpected error pairing with sender: %v", recvErr)
+	}
+	if !bytes.Equal(gotReceiver.PublicKey, receiver.PublicKey) {
+		t.Fatal("sender got the wrong public key")
+	}
+	if !bytes.Equal(gotSender.PublicKey, sender.PublicKey) {
+		t.Fatal("receiver got the wrong public key")
+	}
+}
+
+func TestPairWithWrongKey(t *testing.T) {
+	_, _, sendErr, recvErr := pair(t, pairing{
+		sender:      loadTestIdentity(t),
+		receiver:    loadTestIdentity(t),
+		senderKey:   []byte("session key"),
+		receiverKey: []byte("other key"),
+	})
+	if recvErr != errUnauthenticated {
+		t.Fatalf("unexpected error pairing with sender, got: %v\nwant: %v",
+			recvErr, errUnauthenticated)
+	}
+	// The receiver tells the sender why it gave up in an error frame, instead
+	// of sending its identity.
+	if sendErr == nil || !strings.Contains(sendErr.Error(), "peer gave up") {
+		t.Fatalf("unexpected error pairing with receiver, got: %v", sendErr)
+	}
+}
+
+func TestPairIgnoresStrangers(t *testing.T) {
+	sender, receiver := loadTestIdentity(t), loadTestIdentity(t)
+	key := []byte("session key")
+	// The strangers come from the sender's address, so the receiver has to
+	// hang up on them once they don't send an identity.
+	gotReceiver, gotSender, sendErr, recvErr := pair(t, pairing{
+		sender:      sender,
+		receiver:    receiver,
+		senderKey:   key,
+		receiverKey: key,
+		strangers:   2,
+	})
+	if sendErr != nil {
+		t.Fatalf("unexpected error pairing with receiver: %v", sendErr)
+	}
+	if recvErr != nil {
+		t.Fatalf("unexpected error pairing with sender: %v", recvErr)
+	}
+	if !bytes.Equal(gotReceiver.PublicKey, receiver.PublicKey) {
+		t.Fatal("sender got the wrong public key")
+	}
+	if !bytes.Equal(gotSender.PublicKey, sender.PublicKey) {
+		t.Fatal("receiver got the wrong public key")
+	}
+}
+
+func TestPairOnlyWithHandshakeAddress(t *testing.T) {
+	key := []byte("session key")
+	// Nothing connects from the address that completed the handshake.
+	_, _, sendErr, recvErr := pair(t, pairing{
+		sender:      loadTestIdentity(t),
+		receiver:    loadTestIdentity(t),
+		senderKey:   key,
+		receiverKey: key,
+		senderIP:    "192.0.2.1",
+	})
+	if recvErr == nil {
+		t.Fatal("expected an error pairing with sender, got nil")
+	}
+	if sendErr == nil {
+		t.Fatal("expected an error pairing with receiver, got nil")
+	}
+}
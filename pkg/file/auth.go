@@ -0,0 +1,103 @@
+package file
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+const (
+	// exporterLabel is the label that keying material is exported from each
+	// TLS connection with. That keying material is unique to the connection,
+	// so a MAC over it can't be replayed on another one.
+	exporterLabel = "EXPORTER-lancp-auth"
+
+	// senderAuthLabel and receiverAuthLabel are mixed into the MACs that the
+	// sender and receiver send, respectively, so that neither one's MAC can
+	// be sent back to it.
+	senderAuthLabel   = "lancp sender"
+	receiverAuthLabel = "lancp receiver"
+)
+
+// errUnauthenticated is returned when the machine on the other end of a
+// connection can't prove that it completed the handshake with us.
+var errUnauthenticated = errors.New("peer didn't complete the handshake with" +
+	" us")
+
+// authenticate begins the provided stream with the preamble and an auth frame
+// that proves that we completed the handshake, then checks that the peer's
+// preamble and auth frame prove that it did too. Both auth frames carry a MAC
+// of keying material exported from the TLS connection, keyed with the secret
+// key that the handshake produced, so nobody who wasn't part of the handshake
+// can be on the other end of the connection.
+//
+// label and peerLabel say which side of the session we and the peer are on.
+//
+// timeoutDuration is in seconds.
+func authenticate(
+	s *stream,
+	key []byte,
+	label, peerLabel string,
+	timeoutDuration uint,
+) error {
+	return readWithTimeout(s.conn, timeoutDuration, func() error {
+		// Our preamble is sent first, even if something goes wrong, so that
+		// the peer can make sense of an error frame.
+		if err := net.WritePreamble(s.w); err != nil {
+			return err
+		}
+		ours, err := computeAuth(s, key, label)
+		if err != nil {
+			return err
+		}
+		if err = net.WriteFrame(s.w, net.FrameAuth, ours); err != nil {
+			return err
+		}
+		if err = s.w.Flush(); err != nil {
+			return err
+		}
+
+		if err = net.ReadPreamble(s.r); err != nil {
+			return err
+		}
+		frame, err := s.fr.ExpectFrame(net.FrameAuth)
+		if err != nil {
+			return err
+		}
+		theirs, err := computeAuth(s, key, peerLabel)
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(frame.Payload, theirs) {
+			return errUnauthenticated
+		}
+		return nil
+	})
+}
+
+// computeAuth returns the payload of the auth frame that the side of the
+// session with the provided label sends over the provided stream.
+func computeAuth(s *stream, key []byte, label string) ([]byte, error) {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("connection isn't a TLS connection")
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	state := conn.ConnectionState()
+	keyingMaterial, err := state.ExportKeyingMaterial(exporterLabel, nil,
+		sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export keying material: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(keyingMaterial)
+	return mac.Sum(nil), nil
+}
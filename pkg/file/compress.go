@@ -0,0 +1,139 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	_io "io"
+	"io/ioutil"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// Every way that a file's contents can be encoded, as they're sent in the
+// payload of an encoding frame.
+const (
+	encodingNone byte = iota
+	encodingGzip
+)
+
+const (
+	// compressionSampleSize is the number of bytes at the beginning of a file
+	// that are compressed to decide whether the rest of it is worth
+	// compressing.
+	compressionSampleSize = 64 << 10
+
+	// minCompressionRatio is how much smaller, at least, a file's sample must
+	// get when it's compressed for the file to be sent compressed. Files that
+	// are already compressed, like images and archives, barely shrink at all.
+	minCompressionRatio = 0.9
+)
+
+// writeEncoding decides how the contents that src is about to read should be
+// encoded by sampling the beginning of them, and writes an encoding frame that
+// says so to conn. src must be read from the returned Reader after this. If the
+// contents are going to be compressed, the returned WriteCloser compresses
+// everything written to it, and must be closed once the contents have been
+// written. Otherwise, it's nil.
+func writeEncoding(src _io.Reader, conn _io.Writer) (
+	_io.Reader,
+	_io.WriteCloser,
+	error,
+) {
+	br := bufio.NewReaderSize(src, compressionSampleSize)
+	sample, err := br.Peek(compressionSampleSize)
+	if err != nil && err != _io.EOF {
+		return nil, nil, err
+	}
+
+	encoding := encodingNone
+	if isCompressible(sample) {
+		encoding = encodingGzip
+	}
+	err = net.WriteFrame(conn, net.FrameEncoding, []byte{encoding})
+	if err != nil {
+		return nil, nil, err
+	}
+	if encoding == encodingNone {
+		return br, nil, nil
+	}
+
+	// Favor speed, since the whole point is to send files faster.
+	gz, err := gzip.NewWriterLevel(net.NewFrameWriter(conn), gzip.BestSpeed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return br, gz, nil
+}
+
+// readEncoding reads an encoding frame, and returns a ReadCloser that decodes
+// the file contents that follow it. Once every byte of the file has been read,
+// it must be closed to check that nothing else follows them.
+func readEncoding(fr *net.FrameReader) (_io.ReadCloser, error) {
+	frame, err := fr.ExpectFrame(net.FrameEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame.Payload) != 1 {
+		return nil, fmt.Errorf("got %d byte encoding, want 1 byte",
+			len(frame.Payload))
+	}
+
+	switch frame.Payload[0] {
+	case encodingNone:
+		return ioutil.NopCloser(fr), nil
+	case encodingGzip:
+		gz, err := gzip.NewReader(fr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start decompressing: %v", err)
+		}
+		return &gzipReader{gz}, nil
+	default:
+		return nil, fmt.Errorf("got unknown encoding %d", frame.Payload[0])
+	}
+}
+
+// gzipReader decompresses a file's contents, and makes sure that nothing was
+// compressed after them when it's closed.
+type gzipReader struct {
+	*gzip.Reader
+}
+
+func (r *gzipReader) Close() error {
+	n, err := _io.Copy(ioutil.Discard, r.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to decompress: %v", err)
+	}
+	if n > 0 {
+		return errors.New("sender sent more bytes than expected")
+	}
+
+	return r.Reader.Close()
+}
+
+// isCompressible returns true if the provided sample of a file's contents gets
+// enough smaller when it's compressed to be worth compressing the whole file.
+func isCompressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+
+	counter := &countingWriter{}
+	gz, _ := gzip.NewWriterLevel(counter, gzip.BestSpeed)
+	gz.Write(sample)
+	gz.Close()
+
+	return float64(counter.n) < float64(len(sample))*minCompressionRatio
+}
+
+// countingWriter discards everything written to it, but counts how many bytes
+// were written.
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+package file
+
+import (
+	"bytes"
+	"crypto/rand"
+	_io "io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+func TestEncodingRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.Read(random)
+	tests := []struct {
+		name     string
+		contents []byte
+		want     byte
+	}{
+		{"empty", nil, encodingNone},
+		{"text", bytes.Repeat([]byte("lancp "), 50000), encodingGzip},
+		{"random", random, encodingNone},
+	}
+
+	for _, test := range tests {
+		conn := new(bytes.Buffer)
+		src, compressor, err := writeEncoding(
+			bytes.NewReader(test.contents),
+			conn,
+		)
+		if err != nil {
+			t.Fatalf("%s: unexpected error writing encoding: %v",
+				test.name, err)
+		}
+		dst := _io.Writer(net.NewFrameWriter(conn))
+		if compressor != nil {
+			dst = compressor
+		}
+		if _, err = _io.Copy(dst, src); err != nil {
+			t.Fatalf("%s: unexpected error writing contents: %v",
+				test.name, err)
+		}
+		if compressor != nil {
+			compressor.Close()
+		}
+		net.WriteFrame(conn, net.FrameDigest, nil)
+
+		if got := conn.Bytes()[5]; got != test.want {
+			t.Fatalf("%s: unexpected encoding, got: %d\nwant: %d",
+				test.name, got, test.want)
+		}
+		if test.want == encodingGzip && conn.Len() >= len(test.contents) {
+			t.Fatalf("%s: contents weren't compressed, got %d bytes",
+				test.name, conn.Len())
+		}
+
+		fr := net.NewFrameReader(conn)
+		decoder, err := readEncoding(fr)
+		if err != nil {
+			t.Fatalf("%s: unexpected error reading encoding: %v",
+				test.name, err)
+		}
+		got, err := ioutil.ReadAll(decoder)
+		if err != nil {
+			t.Fatalf("%s: unexpected error reading contents: %v",
+				test.name, err)
+		}
+		if err = decoder.Close(); err != nil {
+			t.Fatalf("%s: unexpected error closing decoder: %v",
+				test.name, err)
+		}
+		if !bytes.Equal(got, test.contents) {
+			t.Fatalf("%s: unexpected contents, got %d bytes, want %d bytes",
+				test.name, len(got), len(test.contents))
+		}
+		if _, err = fr.ExpectFrame(net.FrameDigest); err != nil {
+			t.Fatalf("%s: unexpected error reading digest frame: %v",
+				test.name, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/nchaloult/lancp/pkg/input"
+	"github.com/nchaloult/lancp/pkg/io"
+)
+
+// ErrDeclined is returned by ReceiveFromSender when the user declines to
+// receive what the sender wants to send. The sender is told so, too.
+var ErrDeclined = errors.New("receiver declined the transfer")
+
+// maxHostnameLen is the longest hostname that a sender can send. Anything
+// longer is cut off.
+const maxHostnameLen = 255
+
+// rootSummary describes one of the files or directories that the user on the
+// sender's machine asked to send, along with everything beneath it.
+type rootSummary struct {
+	name     string
+	isDir    bool
+	numFiles int
+	size     int64
+}
+
+// confirmTransfer shows the user who's sending what, and asks them whether they
+// want to receive it. sender describes the sender's machine, like its hostname.
+func confirmTransfer(
+	capturer *input.Capturer,
+	manifest Manifest,
+	sender string,
+) (bool, error) {
+	roots := summarizeRoots(manifest)
+	numFiles := 0
+	for _, root := range roots {
+		numFiles += root.numFiles
+	}
+
+	log.Printf("%s wants to send you %s:\n", sender,
+		describeFiles(numFiles, manifest.TotalSize()))
+	for _, root := range roots {
+		if root.isDir {
+			log.Printf("    %s/ (%s)\n", sanitizeForTerminal(root.name),
+				describeFiles(root.numFiles, root.size))
+		} else {
+			log.Printf("    %s (%s)\n", sanitizeForTerminal(root.name),
+				describeSize(root.size))
+		}
+	}
+
+	return capturer.CaptureConfirmation("Accept?")
+}
+
+// summarizeRoots returns a summary of each of the files and directories that
+// the user on the sender's machine asked to send, in the order that they appear
+// in the provided manifest.
+func summarizeRoots(manifest Manifest) []*rootSummary {
+	var roots []*rootSummary
+	rootsByName := make(map[string]*rootSummary)
+	for _, entry := range manifest {
+		elems := strings.SplitN(entry.Path, "/", 2)
+		root, ok := rootsByName[elems[0]]
+		if !ok {
+			root = &rootSummary{name: elems[0]}
+			rootsByName[elems[0]] = root
+			roots = append(roots, root)
+		}
+		if entry.IsDir {
+			root.isDir = root.isDir || len(elems) == 1
+			continue
+		}
+
+		root.numFiles++
+		if root.size >= 0 {
+			root.size += entry.Size
+		}
+		if entry.IsStream {
+			root.size = -1
+		}
+	}
+
+	return roots
+}
+
+// describeFiles returns a human-readable description of a number of files and
+// their total size, like "3 files, 4.2 MB".
+func describeFiles(numFiles int, size int64) string {
+	noun := "files"
+	if numFiles == 1 {
+		noun = "file"
+	}
+	return fmt.Sprintf("%d %s, %s", numFiles, noun, describeSize(size))
+}
+
+// describeSize returns the provided size in a human-readable format. Negative
+// sizes aren't known ahead of time.
+func describeSize(size int64) string {
+	if size < 0 {
+		return "unknown size"
+	}
+	return io.FormatSize(size)
+}
+
+// sanitizeForTerminal replaces every character in s that isn't printable with
+// a "?", so that the sender can't mess with the receiver's terminal.
+func sanitizeForTerminal(s string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
@@ -1,129 +1,791 @@
 package file
 
 import (
-	"encoding/binary"
+	"bufio"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
+	_io "io"
+	"io/ioutil"
+	"log"
+	_net "net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/nchaloult/lancp/pkg/cert"
+	"github.com/nchaloult/lancp/pkg/input"
 	"github.com/nchaloult/lancp/pkg/io"
 	"github.com/nchaloult/lancp/pkg/net"
 )
 
-const (
-	// TODO: Is this an okay size for this buffer? How big could it ever get?
-	// https://www.ibm.com/support/knowledgecenter/SSEQVQ_8.1.10/client/c_cmd_filespecsyntax.html
-	nameBufLen = 1024
-
-	// Combo of answers from https://stackoverflow.com/questions/35371385/how-can-i-convert-an-int64-into-a-byte-array-in-go
-	sizeBufLen = binary.MaxVarintLen64
-)
-
-// ReceiveFromSender receives a file from the sender along a TLS connection and
-// saves it to disk. It builds a TLS config struct with necessary information to
-// establish a TLS connection, establishes that connection, receives the file's
-// name and size, then the file's contents, and saves it to disk.
+// ReceiveFromSender receives files and directories from the sender along a TLS
+// connection and saves them to disk. It builds a TLS config struct with
+// necessary information to establish a TLS connection, upgrades the provided
+// connection to TLS, checks that the sender knows the secret key that the
+// handshake produced, receives a manifest of every file and directory being
+// sent, then each file's contents, and recreates them on disk, checking that
+// each file's contents match the SHA-256 digest that the sender sends after
+// them. Once it's done, it prints a summary of every file it received.
+//
+// conn is the connection that the sender began the session on, which our
+// certificates were exchanged over. The sender must present senderCert, the
+// certificate that it sent us along it, once it's upgraded to TLS. If the
+// sender wants to send files' contents over more connections, they're accepted
+// on ln, the listener that conn was accepted on, so that every connection in
+// the session goes to the same port.
+//
+// If capturer isn't nil, the user is shown the sender's hostname and what it
+// wants to send, and asked whether to accept it before anything is received. If
+// they decline, the sender is told so, and ErrDeclined is returned.
+//
+// If an earlier transfer of any of those files was interrupted, it asks the
+// sender to only send the bytes that it didn't receive last time.
+//
+// If out isn't nil, every file's contents are written to it, one after the
+// other, instead of being saved to disk. Directories are ignored.
+//
+// compress and multiStream must be true if both machines agreed to compression
+// and sending over several connections, respectively, during the handshake.
+//
+// Returns the manifest that the sender sent, even if something went wrong
+// after it arrived, so that the caller knows what the sender tried to send.
 func ReceiveFromSender(
+	ln _net.Listener,
+	conn _net.Conn,
 	certificate *cert.SelfSignedCert,
-	port string,
+	senderCert []byte,
+	sessionKey []byte,
 	timeoutDuration uint,
-) error {
+	out _io.Writer,
+	compress, multiStream bool,
+	capturer *input.Capturer,
+) (Manifest, error) {
 	// Stand up a TLS conn.
-	cfg, err := cert.GetReceiverTLSConfig(certificate)
+	cfg, err := cert.GetReceiverTLSConfig(certificate, senderCert)
 	if err != nil {
-		return fmt.Errorf("failed to prepare for TLS: %v", err)
+		return nil, fmt.Errorf("failed to prepare for TLS: %v", err)
 	}
-	ln, err := net.CreateTLSListener(cfg, port)
+	upgrade := func(conn _net.Conn) (*stream, error) {
+		s := newStream(net.UpgradeToTLSServer(conn, cfg))
+		if err := authenticate(s, sessionKey, receiverAuthLabel,
+			senderAuthLabel, timeoutDuration); err != nil {
+			s.conn.Close()
+			return nil, fmt.Errorf("failed to authenticate sender: %v", err)
+		}
+		return s, nil
+	}
+	// Anything else that connects to our port while we wait for the sender's
+	// other connections is hung up on.
+	senderAddr := conn.RemoteAddr()
+	accept := func() (*stream, error) {
+		deadline := time.Now().Add(
+			time.Duration(timeoutDuration) * time.Second)
+		var joinErr error
+		for {
+			conn, err := net.AcceptFrom(ln, senderAddr, deadline)
+			if err != nil {
+				if joinErr != nil {
+					return nil, joinErr
+				}
+				return nil, err
+			}
+			if joinErr = expectJoin(conn, timeoutDuration); joinErr == nil {
+				return upgrade(conn)
+			}
+			conn.Close()
+		}
+	}
+	s, err := upgrade(conn)
 	if err != nil {
-		return fmt.Errorf("failed to create TLS listener: %v", err)
+		return nil, err
 	}
-	defer ln.Close()
-	conn, err := net.EstablishConn(ln, timeoutDuration)
+	defer s.conn.Close()
+
+	manifest, err := receiveFiles(s, accept, out, compress, multiStream,
+		capturer, timeoutDuration)
 	if err != nil {
+		sendError(s.w, err)
+		return manifest, err
+	}
+
+	return manifest, nil
+}
+
+// receiveFiles carries out the receiver's side of a lancp session over the
+// provided stream, which has already been authenticated. If the sender wants to
+// send files' contents over more connections, they're accepted with accept.
+// Returns the sender's manifest, if it arrived.
+func receiveFiles(
+	main *stream,
+	accept func() (*stream, error),
+	out _io.Writer,
+	compress, multiStream bool,
+	capturer *input.Capturer,
+	timeoutDuration uint,
+) (Manifest, error) {
+	// Receive the sender's hostname and manifest, and find out how many
+	// connections it wants to use.
+	var hostname string
+	var manifest Manifest
+	var streamsPayload []byte
+	numStreams := 1
+	err := readWithTimeout(main.conn, timeoutDuration, func() error {
+		frame, err := main.fr.ExpectFrame(net.FrameHello)
+		if err != nil {
+			return err
+		}
+		if len(frame.Payload) > maxHostnameLen {
+			frame.Payload = frame.Payload[:maxHostnameLen]
+		}
+		hostname = string(frame.Payload)
+		if frame, err = main.fr.ExpectFrame(net.FrameManifest); err != nil {
+			return err
+		}
+		if manifest, err = decodeManifest(frame.Payload); err != nil {
+			return err
+		}
+		if !multiStream {
+			return nil
+		}
+		if frame, err = main.fr.ExpectFrame(net.FrameStreams); err != nil {
+			return err
+		}
+		streamsPayload = frame.Payload
+		numStreams, err = decodeStreams(streamsPayload)
 		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive manifest from sender: %v", err)
 	}
-	defer conn.Close()
 
-	// Receive the file's name and size from the sender.
-	nameBuf, err := net.ReceiveMessageWithKnownSize(
-		nameBufLen,
-		conn,
-		timeoutDuration,
-	)
+	// Accept the sender's other connections before asking the user, since
+	// our certificates could expire while they think it over.
+	streams := []*stream{main}
+	if numStreams > 1 {
+		extraStreams, err := acceptExtraStreams(accept, numStreams-1,
+			streamsPayload, timeoutDuration)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to accept more connections from"+
+				" sender: %v", err)
+		}
+		defer closeStreams(extraStreams)
+		streams = append(streams, extraStreams...)
+	}
+
+	if capturer != nil {
+		sender := main.conn.RemoteAddr().String()
+		if hostname != "" {
+			sender = fmt.Sprintf("%s (%s)", sanitizeForTerminal(hostname),
+				sender)
+		}
+		accepted, err := confirmTransfer(capturer, manifest, sender)
+		if err != nil {
+			return manifest, fmt.Errorf("failed to capture confirmation input from"+
+				" user: %v", err)
+		}
+		if !accepted {
+			return manifest, ErrDeclined
+		}
+	}
+
+	// Tell the sender where to resume sending each file from. There's nothing
+	// to resume from if we're writing to out.
+	var offsets []int64
+	var resumedSize int64
+	for _, entry := range manifest {
+		if entry.IsDir {
+			continue
+		}
+		var offset int64
+		if out == nil {
+			offset = getResumeOffset(entry)
+		}
+		if offset > 0 {
+			log.Printf("Resuming %s from %s\n", entry.Path,
+				io.FormatSize(offset))
+		}
+		offsets = append(offsets, offset)
+		resumedSize += offset
+	}
+	err = net.WriteFrame(main.w, net.FrameOffsets, encodeOffsets(offsets))
+	if err == nil {
+		err = main.w.Flush()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to receive file name from sender: %v", err)
+		return manifest, fmt.Errorf("failed to send offsets to sender: %v", err)
+	}
+
+	start := time.Now()
+	bar := io.NewProgressBar(remainingSize(manifest, resumedSize))
+	// Maps the first element of each entry's path to the name it was given on
+	// disk, in case something with that name already exists.
+	roots := make(map[string]string)
+	var received []string
+	var totalSize int64
+	for _, entry := range manifest {
+		if entry.IsDir {
+			if out != nil {
+				continue
+			}
+			if _, err := getLocalPath(entry, roots); err != nil {
+				bar.Finish()
+				return manifest, fmt.Errorf("failed to create %s on disk: %v",
+					entry.Path, err)
+			}
+			continue
+		}
+
+		offset := offsets[0]
+		offsets = offsets[1:]
+		var localPath string
+		var size int64
+		if out != nil {
+			localPath = entry.Path + " to stdout"
+			size, err = receiveFile(entry, 0, sha256.New(), out, bar,
+				compress, main.fr)
+		} else {
+			localPath, size, err = receiveFileToDisk(entry, offset, roots, bar,
+				compress, streams)
+		}
+		if err != nil {
+			bar.Finish()
+			return manifest, fmt.Errorf("failed to receive %s: %v", entry.Path, err)
+		}
+		received = append(received, fmt.Sprintf("%s (%s)",
+			localPath, io.FormatSize(size)))
+		totalSize += size
+	}
+	bar.Finish()
+
+	// Let the sender know that everything arrived intact.
+	if err = net.WriteFrame(main.w, net.FrameVerified, nil); err != nil {
+		return manifest, fmt.Errorf("failed to confirm transfer with sender: %v", err)
+	}
+	if err = main.w.Flush(); err != nil {
+		return manifest, fmt.Errorf("failed to confirm transfer with sender: %v", err)
 	}
-	name := string(nameBuf.Bytes[:nameBuf.Length])
-	sizeBuf, err := net.ReceiveMessageWithKnownSize(
-		sizeBufLen,
-		conn,
-		timeoutDuration,
-	)
+
+	for _, line := range received {
+		log.Printf("Received %s\n", line)
+	}
+	noun := "files"
+	if len(received) == 1 {
+		noun = "file"
+	}
+	log.Printf("Received %d %s (%s) in %v\n",
+		len(received),
+		noun,
+		io.FormatSize(totalSize),
+		time.Since(start).Round(time.Millisecond))
+
+	return manifest, nil
+}
+
+// SendToReceiver sends the files and directories in the provided manifest to
+// the receiver along one TLS connection. It builds a TLS config struct with
+// necessary information to establish a TLS connection, upgrades the provided
+// connection to TLS, checks that the receiver knows the secret key that the
+// handshake produced, sends this machine's hostname and the manifest, and sends
+// each file's contents, starting from wherever the receiver asks it to,
+// followed by its SHA-256 digest. Then, it waits for the receiver to confirm
+// that every file's digest matched what it received.
+//
+// conn is the connection that we began the session on, which our certificates
+// were exchanged over. The receiver must present receiverCert, the certificate
+// that it sent us along it, and we present certificate in return.
+//
+// Since the user on the receiver's machine may be asked whether they want to
+// receive the files, the sender waits up to confirmationTimeoutDuration seconds
+// for the receiver to respond to the manifest.
+//
+// If compress is true, which it should only be if both machines agreed to
+// compression during the handshake, each file's contents are compressed before
+// they're sent, unless they don't seem to be worth compressing.
+//
+// If numStreams is more than 1, which it should only be if both machines agreed
+// to it during the handshake, that many connections are opened to the same
+// address and port as conn, and large files are split up and sent over all of
+// them at the same time.
+func SendToReceiver(
+	conn _net.Conn,
+	manifest Manifest,
+	certificate *cert.SelfSignedCert,
+	receiverCert []byte,
+	sessionKey []byte,
+	compress bool,
+	numStreams int,
+	timeoutDuration, confirmationTimeoutDuration uint,
+) error {
+	// Connect to the receiver's TLS conn with the provided certs.
+	tlsCfg, err := cert.GetSenderTLSConfig(certificate, receiverCert)
 	if err != nil {
-		return fmt.Errorf("failed to receive file size from sender: %v", err)
+		return fmt.Errorf("failed to prepare for TLS: %v", err)
+	}
+	upgrade := func(conn _net.Conn) (*stream, error) {
+		s := newStream(net.UpgradeToTLSClient(conn, tlsCfg))
+		if err := authenticate(s, sessionKey, senderAuthLabel,
+			receiverAuthLabel, timeoutDuration); err != nil {
+			s.conn.Close()
+			return nil, fmt.Errorf("failed to authenticate receiver: %v", err)
+		}
+		return s, nil
 	}
-	size, bytesRead := binary.Varint(sizeBuf.Bytes)
-	if bytesRead == 0 {
-		if size == 0 {
-			return errors.New("failed to receive file size from sender:" +
-				" buffer too small on our end (this should never happen, but" +
-				" it happened lol)")
+	addr := conn.RemoteAddr().String()
+	dial := func() (*stream, error) {
+		conn, err := net.ConnectToTCPConn(addr, timeoutDuration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to receiver: %v", err)
+		}
+		if err = net.WriteFrame(conn, net.FrameJoin, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to join session: %v", err)
 		}
-		return errors.New("failed to receive file size from sender: size is" +
-			" larger than the max value of a 64-bit integer (this should" +
-			" never happen, but it happened lol)")
+		return upgrade(conn)
+	}
+	s, err := upgrade(conn)
+	if err != nil {
+		return err
 	}
+	defer s.conn.Close()
 
-	file, err := io.CreateNewFileOnDisk(name)
+	err = sendFiles(s, dial, manifest, compress, numStreams, timeoutDuration,
+		confirmationTimeoutDuration)
 	if err != nil {
-		return fmt.Errorf("failed to create a new file on disk: %v", err)
+		sendError(s.w, err)
+		return err
 	}
-	defer file.Close()
 
-	return io.ReceiveFileFromConn(file, size, conn)
+	return nil
 }
 
-// SendToReceiver sends a file to the receiver at the provided address along a
-// TLS connection. It builds a TLS config struct with necessary information to
-// establish a TLS connection, establishes that connection, sends the name and
-// size of the file at the provided path, and sends the file's contents.
-func SendToReceiver(
-	addr, filePath string,
-	certificate []byte,
-	timeoutDuration, numRetries uint,
+// sendFiles carries out the sender's side of a lancp session over the provided
+// stream, which has already been authenticated. If numStreams is more than 1,
+// more connections are opened with dial.
+func sendFiles(
+	main *stream,
+	dial func() (*stream, error),
+	manifest Manifest,
+	compress bool,
+	numStreams int,
+	timeoutDuration, confirmationTimeoutDuration uint,
 ) error {
-	// Connect to the receiver's TLS conn with the provided cert.
-	tlsCfg := cert.GetSenderTLSConfig(certificate)
-	conn, err := net.ConnectToTLSConn(addr, tlsCfg, timeoutDuration)
+	// The receiver can do without our hostname, so don't fail if we can't
+	// find it.
+	hostname, _ := os.Hostname()
+	var streamsPayload []byte
+	err := net.WriteFrame(main.w, net.FrameHello, []byte(hostname))
+	if err == nil {
+		err = net.WriteFrame(main.w, net.FrameManifest,
+			encodeManifest(manifest))
+	}
+	if err == nil && numStreams > 1 {
+		if streamsPayload, err = encodeStreams(numStreams); err == nil {
+			err = net.WriteFrame(main.w, net.FrameStreams, streamsPayload)
+		}
+	}
+	if err == nil {
+		err = main.w.Flush()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to establish TLS connection with receiver:"+
-			" %v", err)
+		return fmt.Errorf("failed to send manifest: %v", err)
+	}
+
+	// Open our other connections while the receiver still has the manifest in
+	// hand. The user on the receiver's machine may take longer to accept the
+	// transfer than our certificates last, so it's too late to open them once
+	// they have.
+	streams := []*stream{main}
+	if numStreams > 1 {
+		extraStreams, err := dialExtraStreams(dial, numStreams-1,
+			streamsPayload)
+		if err != nil {
+			return fmt.Errorf("failed to open more connections with"+
+				" receiver: %v", err)
+		}
+		defer closeStreams(extraStreams)
+		streams = append(streams, extraStreams...)
 	}
-	defer conn.Close()
 
-	f, err := os.Open(filePath)
+	// Find out where the receiver wants us to start sending each file from.
+	var offsets []int64
+	err = readWithTimeout(main.conn, confirmationTimeoutDuration, func() error {
+		frame, err := main.fr.ExpectFrame(net.FrameOffsets)
+		if err != nil {
+			return err
+		}
+		offsets, err = decodeOffsets(frame.Payload, manifest)
+		return err
+	})
 	if err != nil {
+		return fmt.Errorf("failed to receive offsets from receiver: %v", err)
+	}
+	var resumedSize int64
+	for _, offset := range offsets {
+		resumedSize += offset
+	}
+
+	bar := io.NewProgressBar(remainingSize(manifest, resumedSize))
+	var rehashSize int64
+	for _, entry := range manifest {
+		if entry.IsDir {
+			continue
+		}
+
+		offset := offsets[0]
+		offsets = offsets[1:]
+		f := os.Stdin
+		if !entry.IsStream {
+			if f, err = os.Open(entry.localPath); err != nil {
+				bar.Finish()
+				return err
+			}
+		}
+		if ranges := splitRanges(entry, offset, len(streams)); ranges != nil {
+			err = sendFileInParallel(f, ranges, streams, bar, compress)
+			rehashSize += entry.Size
+		} else {
+			err = sendFile(f, entry.Size, offset, bar, compress, main.w)
+		}
+		f.Close()
+		if err != nil {
+			bar.Finish()
+			return fmt.Errorf("failed to send %s: %v", entry.localPath, err)
+		}
+	}
+	bar.Finish()
+	if err = main.w.Flush(); err != nil {
 		return err
 	}
-	// Send file name and size.
-	fileInfo, err := f.Stat()
+
+	// Wait for the receiver to confirm that every file arrived intact.
+	verifyTimeout := getVerifyTimeout(timeoutDuration, rehashSize)
+	err = readWithTimeout(main.conn, verifyTimeout, func() error {
+		_, err := main.fr.ExpectFrame(net.FrameVerified)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get file info for %s: %v", filePath, err)
+		return fmt.Errorf("receiver didn't confirm that every file arrived"+
+			" intact: %v", err)
 	}
-	if err = net.SendMessage([]byte(fileInfo.Name()), conn); err != nil {
+
+	return nil
+}
+
+// sendFile sends the provided file's contents along the provided connection in
+// data frames, starting offset bytes into the file, followed by a digest frame
+// with the SHA-256 digest of the whole file. If compress is true, they're
+// preceded by an encoding frame, and compressed if they're worth compressing.
+func sendFile(
+	f *os.File,
+	size, offset int64,
+	bar *io.ProgressBar,
+	compress bool,
+	conn *bufio.Writer,
+) error {
+	// The receiver already has the bytes before offset, but they're still part
+	// of the digest.
+	h := sha256.New()
+	if _, err := _io.CopyN(h, f, offset); err != nil {
+		return err
+	}
+
+	src := _io.TeeReader(bar.Track(f), h)
+	if err := sendContents(src, size-offset, compress, conn); err != nil {
+		return err
+	}
+
+	return net.WriteFrame(conn, net.FrameDigest, h.Sum(nil))
+}
+
+// sendContents sends size bytes read from src along the provided connection in
+// data frames. If compress is true, they're preceded by an encoding frame, and
+// compressed if they're worth compressing.
+func sendContents(
+	src _io.Reader,
+	size int64,
+	compress bool,
+	conn *bufio.Writer,
+) error {
+	// Progress is tracked before the contents are compressed, so it's always
+	// reported in terms of the file's actual size.
+	dst := _io.Writer(net.NewFrameWriter(conn))
+	var compressor _io.WriteCloser
+	if compress {
+		var err error
+		if src, compressor, err = writeEncoding(src, conn); err != nil {
+			return err
+		}
+		if compressor != nil {
+			dst = compressor
+		}
+	}
+
+	if err := io.SendFileAlongConn(src, size, dst); err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Close()
+	}
+
+	return nil
+}
+
+// receiveFileToDisk receives the provided entry's contents, starting offset
+// bytes into the file, and saves them to disk. See receiveFile and
+// receiveFileInParallel for how the contents are verified. If they're
+// corrupted, the partially-received file is deleted.
+//
+// If the file is large enough, it's received over every one of the provided
+// streams at once. Otherwise, it's received over the first one.
+//
+// Returns the path that the file was saved to, and its size.
+func receiveFileToDisk(
+	entry Entry,
+	offset int64,
+	roots map[string]string,
+	bar *io.ProgressBar,
+	compress bool,
+	streams []*stream,
+) (string, int64, error) {
+	localPath, err := getLocalPath(entry, roots)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create %s on disk: %v",
+			entry.Path, err)
+	}
+
+	h := sha256.New()
+	file, err := openPartialFile(entry, offset, h)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create a new file on disk: %v", err)
+	}
+	var n int64
+	if ranges := splitRanges(entry, offset, len(streams)); ranges != nil {
+		n, err = receiveFileInParallel(entry, file, ranges, streams, bar,
+			compress)
+	} else {
+		n, err = receiveFile(entry, offset, h, file, bar, compress,
+			streams[0].fr)
+	}
+	file.Close()
+	if errors.Is(err, errCorrupted) {
+		discardPartialFile(entry)
+		return "", 0, fmt.Errorf("%v, so it was deleted", err)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	if !strings.Contains(entry.Path, "/") {
+		// Wait until now to claim a name for files that aren't in a directory,
+		// so interrupted transfers don't leave empty files behind.
+		if localPath, err = reserveFileName(localPath); err != nil {
+			return "", 0, fmt.Errorf("failed to create a new file on disk: %v",
+				err)
+		}
+	}
+	if err = completePartialFile(entry, localPath); err != nil {
+		return "", 0, fmt.Errorf("failed to move file into place: %v", err)
+	}
+
+	return localPath, offset + n, nil
+}
+
+// errCorrupted is wrapped by errors that receiveFile returns when the contents
+// it received don't match their digest.
+var errCorrupted = errors.New("contents are corrupted")
+
+// receiveFile receives the provided entry's contents from data frames, starting
+// offset bytes into the file, and writes them to dst. h must already have
+// hashed the first offset bytes of the file. Then, it reads a digest frame, and
+// checks that its SHA-256 digest matches what was received, as well as the
+// digest in the manifest.
+//
+// If compress is true, the contents are preceded by an encoding frame, and
+// decompressed if need be.
+//
+// Returns the number of bytes that were received.
+func receiveFile(
+	entry Entry,
+	offset int64,
+	h hash.Hash,
+	dst _io.Writer,
+	bar *io.ProgressBar,
+	compress bool,
+	fr *net.FrameReader,
+) (int64, error) {
+	size := entry.Size
+	if !entry.IsStream {
+		size -= offset
+	}
+	n, err := receiveContents(dst, size, h, bar, compress, fr)
+	if err != nil {
+		return n, err
+	}
+	if err = checkDigest(h, fr); err != nil {
+		return n, err
+	}
+
+	var got [sha256.Size]byte
+	copy(got[:], h.Sum(nil))
+	if !entry.IsStream && got != entry.Hash {
+		return n, fmt.Errorf("%w: file changed on the sender's machine while"+
+			" it was being sent", errCorrupted)
+	}
+
+	return n, nil
+}
+
+// receiveContents receives size bytes from data frames, writes them to dst, and
+// hashes them with h. If size is negative, it receives every data frame until
+// the next frame that isn't one. If compress is true, the contents are preceded
+// by an encoding frame, and decompressed if need be.
+//
+// Returns the number of bytes that were received.
+func receiveContents(
+	dst _io.Writer,
+	size int64,
+	h hash.Hash,
+	bar *io.ProgressBar,
+	compress bool,
+	fr *net.FrameReader,
+) (int64, error) {
+	src := _io.ReadCloser(ioutil.NopCloser(fr))
+	if compress {
+		var err error
+		if src, err = readEncoding(fr); err != nil {
+			return 0, err
+		}
+	}
+
+	tracked := _io.TeeReader(bar.Track(src), h)
+	n, err := io.ReceiveFileFromConn(dst, size, tracked)
+	if err == _io.EOF {
+		return n, errors.New("sender sent fewer bytes than expected")
+	}
+	if err != nil {
+		return n, err
+	}
+
+	return n, src.Close()
+}
+
+// checkDigest reads a digest frame, and checks that the SHA-256 digest in it
+// matches the one that h has computed.
+func checkDigest(h hash.Hash, fr *net.FrameReader) error {
+	frame, err := fr.ExpectFrame(net.FrameDigest)
+	if err != nil {
 		return err
 	}
-	// Combo of answers from https://stackoverflow.com/questions/35371385/how-can-i-convert-an-int64-into-a-byte-array-in-go
-	//
-	// We're wasting 1-2 bytes of space by making fileSizeBuf large enough to
-	// hold a signed 64-bit integer, but I'm fine with that for the sake of
-	// convenience :)
-	fileSizeBuf := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutVarint(fileSizeBuf, fileInfo.Size())
-	if err = net.SendMessage(fileSizeBuf[:n], conn); err != nil {
+	var want [sha256.Size]byte
+	if len(frame.Payload) != len(want) {
+		return fmt.Errorf("got %d byte digest, want %d bytes",
+			len(frame.Payload), len(want))
+	}
+	copy(want[:], frame.Payload)
+	var got [sha256.Size]byte
+	copy(got[:], h.Sum(nil))
+	if got != want {
+		return fmt.Errorf("%w: got SHA-256 digest %x, want %x",
+			errCorrupted, got, want)
+	}
+
+	return nil
+}
+
+// remainingSize returns the number of bytes in the provided manifest that
+// still need to be sent, given how many bytes were already received in an
+// earlier transfer. Returns -1 if that isn't known ahead of time.
+func remainingSize(manifest Manifest, resumedSize int64) int64 {
+	totalSize := manifest.TotalSize()
+	if totalSize < 0 {
+		return totalSize
+	}
+	return totalSize - resumedSize
+}
+
+// sendError lets the peer know why we're giving up on the session, if it's
+// still listening.
+func sendError(w *bufio.Writer, err error) {
+	net.WriteFrame(w, net.FrameError, []byte(err.Error()))
+	w.Flush()
+}
+
+// readWithTimeout blocks until read, which reads from the provided connection,
+// returns. If it doesn't return within the specified timeout duration, it
+// closes the connection and returns an error that specifies such.
+//
+// timeoutDuration is in seconds.
+func readWithTimeout(
+	conn _net.Conn,
+	timeoutDuration uint,
+	read func() error,
+) error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- read()
+	}()
+
+	select {
+	case err := <-errChan:
 		return err
+	case <-time.After(time.Duration(timeoutDuration) * time.Second):
+		// Unblock the goroutine above.
+		conn.Close()
+		return fmt.Errorf("timed out after %d seconds", timeoutDuration)
+	}
+}
+
+// getLocalPath returns the path that the provided entry should be saved to on
+// disk. The first time it sees a directory whose path has a particular first
+// element, it creates that directory in the user's current directory with a
+// unique name, and remembers it in roots.
+//
+// Directories that aren't the first element of their path are created, too,
+// along with the directories that files are in. None of them can be symlinks,
+// so that nothing is ever saved outside of the user's current directory. Files
+// that aren't in a directory aren't created.
+//
+// The entry's path must already have been checked with validatePath.
+func getLocalPath(entry Entry, roots map[string]string) (string, error) {
+	elems := strings.Split(entry.Path, "/")
+	if len(elems) == 1 && !entry.IsDir {
+		return elems[0], nil
+	}
+	root, ok := roots[elems[0]]
+	if !ok {
+		var err error
+		if root, err = io.CreateNewDirOnDisk(elems[0]); err != nil {
+			return "", err
+		}
+		roots[elems[0]] = root
+	}
+
+	dirs := elems[1:]
+	if !entry.IsDir {
+		dirs = dirs[:len(dirs)-1]
 	}
+	dir, err := makeDirsBeneath(root, dirs)
+	if err != nil {
+		return "", err
+	}
+	if entry.IsDir {
+		return dir, nil
+	}
+
+	return filepath.Join(dir, elems[len(elems)-1]), nil
+}
+
+// reserveFileName creates an empty file in the user's current directory with
+// a unique name based on the provided one, and returns that name.
+func reserveFileName(name string) (string, error) {
+	file, err := io.CreateNewFileOnDisk(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
 
-	return io.SendFileAlongConn(f, fileInfo.Size(), conn)
+	return file.Name(), nil
 }
@@ -0,0 +1,589 @@
+package file
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	_io "io"
+	"io/ioutil"
+	"math/big"
+	_net "net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/cert"
+	"github.com/nchaloult/lancp/pkg/input"
+	"github.com/nchaloult/lancp/pkg/io"
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// session describes a transfer between a sender and a receiver that are both
+// run by runSession.
+type session struct {
+	// paths are the files and directories to send, relative to the sender's
+	// directory.
+	paths []string
+
+	// stdin, if it isn't nil, is piped into the sender's stdin, so that it can
+	// be sent with io.StdinPath.
+	stdin []byte
+
+	// out, if it isn't nil, is where the receiver writes what it receives
+	// instead of saving it to disk.
+	out _io.Writer
+
+	compress   bool
+	numStreams int
+
+	// timeoutDuration is how long, in seconds, both machines wait for each
+	// other. If it's zero, they wait for 5 seconds.
+	timeoutDuration uint
+
+	// confirmation is what the user on the receiver's machine types in when
+	// they're asked to accept the transfer, after confirmationDelay. If it's
+	// empty, they aren't asked.
+	confirmation      string
+	confirmationDelay time.Duration
+
+	// certLifetime is how long both machines' certificates are valid for. If
+	// it's zero, they're valid for a minute.
+	certLifetime time.Duration
+
+	// strangers is the number of connections that are made to the receiver's
+	// port right after the sender's first one, which each send it a frame that
+	// it doesn't expect.
+	strangers int
+
+	// beforeSend, if it isn't nil, is called from the receiver's directory
+	// once the manifest has been built, right before the transfer begins.
+	beforeSend func(manifest Manifest)
+}
+
+// result is what happened during a session that was run by runSession.
+type result struct {
+	sendErr error
+	recvErr error
+
+	// sent is the number of bytes that the sender wrote to its first
+	// connection, including TLS's overhead.
+	sent int64
+}
+
+// runSession runs both ends of the provided session over a loopback TCP
+// listener, with the sender in senderDir and the receiver in receiverDir.
+func runSession(
+	t *testing.T,
+	s session,
+	senderDir, receiverDir string,
+) result {
+	t.Helper()
+	lifetime := s.certLifetime
+	if lifetime == 0 {
+		lifetime = time.Minute
+	}
+	senderCert := generateTestCert(t, lifetime)
+	receiverCert := generateTestCert(t, lifetime)
+	key := []byte("session key")
+	numStreams := s.numStreams
+	if numStreams == 0 {
+		numStreams = 1
+	}
+	timeoutDuration := s.timeoutDuration
+	if timeoutDuration == 0 {
+		timeoutDuration = 5
+	}
+
+	var roots []string
+	for _, path := range s.paths {
+		if path != io.StdinPath {
+			path = filepath.Join(senderDir, path)
+		}
+		roots = append(roots, path)
+	}
+	manifest, err := BuildManifest(roots...)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest: %v", err)
+	}
+	if s.stdin != nil {
+		stdin, err := ioutil.TempFile(senderDir, "stdin")
+		if err != nil {
+			t.Fatalf("unexpected error creating stdin: %v", err)
+		}
+		_, err = stdin.Write(s.stdin)
+		if err == nil {
+			_, err = stdin.Seek(0, _io.SeekStart)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error writing stdin: %v", err)
+		}
+		// The sender closes it once it's done with it.
+		defer func(orig *os.File) { os.Stdin = orig }(os.Stdin)
+		os.Stdin = stdin
+	}
+
+	// The receiver saves everything in its current directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("unexpected error getting current directory: %v", err)
+	}
+	if err = os.Chdir(receiverDir); err != nil {
+		t.Fatalf("unexpected error changing directory: %v", err)
+	}
+	defer os.Chdir(wd)
+	if s.beforeSend != nil {
+		s.beforeSend(manifest)
+	}
+
+	ln, err := _net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer ln.Close()
+	var capturer *input.Capturer
+	if s.confirmation != "" {
+		capturer, err = input.NewCapturer(">", "sender", &delayedReader{
+			delay: s.confirmationDelay,
+			r:     strings.NewReader(s.confirmation + "\n"),
+		}, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("unexpected error creating capturer: %v", err)
+		}
+	}
+	recvErrs := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			recvErrs <- err
+			return
+		}
+		defer conn.Close()
+		_, err = ReceiveFromSender(ln, conn, receiverCert, senderCert.Bytes,
+			key, timeoutDuration, s.out, s.compress, numStreams > 1, capturer)
+		recvErrs <- err
+	}()
+
+	dialed, err := _net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error connecting to receiver: %v", err)
+	}
+	conn := &countingConn{Conn: dialed}
+	defer conn.Close()
+	for i := 0; i < s.strangers; i++ {
+		stranger, err := _net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error connecting to receiver: %v", err)
+		}
+		defer stranger.Close()
+		net.WriteFrame(stranger, net.FrameHello, []byte("stranger"))
+	}
+	sendErr := SendToReceiver(conn, manifest, senderCert, receiverCert.Bytes,
+		key, s.compress, numStreams, timeoutDuration, 30)
+
+	return result{sendErr, <-recvErrs, conn.n}
+}
+
+// countingConn counts the bytes that are written to it.
+type countingConn struct {
+	_net.Conn
+	n int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// generateTestCert returns a self-signed certificate for 127.0.0.1 that's valid
+// for the provided amount of time.
+func generateTestCert(
+	t *testing.T,
+	lifetime time.Duration,
+) *cert.SelfSignedCert {
+	t.Helper()
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error generating key: %v", err)
+	}
+	template := x509.Certificate{
+		IPAddresses:  []_net.IP{_net.ParseIP("127.0.0.1")},
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Second),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		sk.Public(), sk)
+	if err != nil {
+		t.Fatalf("unexpected error creating certificate: %v", err)
+	}
+	skBytes, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		t.Fatalf("unexpected error encoding private key: %v", err)
+	}
+
+	return &cert.SelfSignedCert{
+		Bytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		SK: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY",
+			Bytes: skBytes}),
+	}
+}
+
+// delayedReader waits for delay before its first read from r, like a user who
+// takes a while to answer a prompt.
+type delayedReader struct {
+	delay   time.Duration
+	r       _io.Reader
+	started bool
+}
+
+func (d *delayedReader) Read(p []byte) (int, error) {
+	if !d.started {
+		d.started = true
+		time.Sleep(d.delay)
+	}
+	return d.r.Read(p)
+}
+
+// tempDirs returns a new sender directory and receiver directory that are
+// removed once the test is over.
+func tempDirs(t *testing.T) (senderDir, receiverDir string) {
+	t.Helper()
+	senderDir, err := ioutil.TempDir("", "lancp-sender")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	receiverDir, err = ioutil.TempDir("", "lancp-receiver")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(senderDir)
+		os.RemoveAll(receiverDir)
+	})
+
+	return senderDir, receiverDir
+}
+
+// writeTestFile writes size random bytes to a new file with the provided name
+// in dir, and returns them.
+func writeTestFile(t *testing.T, dir, name string, size int) []byte {
+	t.Helper()
+	contents := make([]byte, size)
+	rand.Read(contents)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), contents,
+		0644); err != nil {
+		t.Fatalf("unexpected error writing %s: %v", name, err)
+	}
+
+	return contents
+}
+
+// writePartialFile leaves the provided contents behind in the current
+// directory as the partially-received file for entry, as if an earlier
+// transfer of it had been interrupted.
+func writePartialFile(t *testing.T, entry Entry, contents []byte) {
+	t.Helper()
+	partialPath, _ := getPartialPaths(entry)
+	if err := ioutil.WriteFile(partialPath, contents, 0644); err != nil {
+		t.Fatalf("unexpected error writing partial file: %v", err)
+	}
+	if err := writeJournal(entry, newJournal(entry)); err != nil {
+		t.Fatalf("unexpected error writing journal: %v", err)
+	}
+}
+
+// checkReceivedFile checks that the file with the provided name in dir has the
+// provided contents.
+func checkReceivedFile(t *testing.T, dir, name string, want []byte) {
+	t.Helper()
+	got, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("unexpected error reading received %s: %v", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("received %s doesn't match what was sent", name)
+	}
+}
+
+// checkSucceeded checks that neither end of a session ran into an error.
+func checkSucceeded(t *testing.T, res result) {
+	t.Helper()
+	if res.sendErr != nil {
+		t.Fatalf("unexpected error sending: %v", res.sendErr)
+	}
+	if res.recvErr != nil {
+		t.Fatalf("unexpected error receiving: %v", res.recvErr)
+	}
+}
+
+// checkNoPartialFiles checks that no partially-received files or journals were
+// left behind in dir.
+func checkNoPartialFiles(t *testing.T, dir string) {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, partialFilePrefix+"*"))
+	if err != nil {
+		t.Fatalf("unexpected error looking for partial files: %v", err)
+	}
+	if len(matches) > 0 {
+		t.Fatalf("partial files were left behind: %v", matches)
+	}
+}
+
+// checkNothingSaved checks that nothing at all was saved in dir.
+func checkNothingSaved(t *testing.T, dir string) {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error reading directory: %v", err)
+	}
+	for _, info := range infos {
+		t.Errorf("%s was saved to disk", info.Name())
+	}
+}
+
+func TestTransferResumesPartialFile(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	const size, received = 1 << 20, 900 << 10
+	want := writeTestFile(t, senderDir, "a.bin", size)
+
+	// An earlier transfer was interrupted after the first received bytes
+	// arrived.
+	res := runSession(t, session{
+		paths: []string{"a.bin"},
+		beforeSend: func(manifest Manifest) {
+			writePartialFile(t, manifest[0], want[:received])
+		},
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	checkReceivedFile(t, receiverDir, "a.bin", want)
+	checkNoPartialFiles(t, receiverDir)
+	if res.sent >= size-received+64<<10 {
+		t.Fatalf("sender sent %d bytes, want only about the last %d", res.sent,
+			size-received)
+	}
+}
+
+func TestTransferDeletesCorruptedFile(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	writeTestFile(t, senderDir, "a.bin", 64<<10)
+
+	// What an earlier transfer left behind doesn't match the start of the
+	// sender's file, so the digest of what's saved won't match.
+	corrupted := make([]byte, 32<<10)
+	rand.Read(corrupted)
+	res := runSession(t, session{
+		paths: []string{"a.bin"},
+		beforeSend: func(manifest Manifest) {
+			writePartialFile(t, manifest[0], corrupted)
+		},
+	}, senderDir, receiverDir)
+	if res.recvErr == nil ||
+		!strings.Contains(res.recvErr.Error(), errCorrupted.Error()) {
+		t.Fatalf("unexpected error receiving, got: %v\nwant: %v", res.recvErr,
+			errCorrupted)
+	}
+	if res.sendErr == nil {
+		t.Fatal("expected an error sending, got nil")
+	}
+	if _, err := os.Stat(filepath.Join(receiverDir, "a.bin")); err == nil {
+		t.Fatal("corrupted file was saved")
+	}
+	checkNoPartialFiles(t, receiverDir)
+}
+
+func TestTransferFromStdinToStdout(t *testing.T) {
+	want := make([]byte, 100<<10)
+	rand.Read(want)
+
+	for _, compress := range []bool{false, true} {
+		senderDir, receiverDir := tempDirs(t)
+		out := new(bytes.Buffer)
+		res := runSession(t, session{
+			paths:    []string{io.StdinPath},
+			stdin:    want,
+			out:      out,
+			compress: compress,
+		}, senderDir, receiverDir)
+		checkSucceeded(t, res)
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("received stream doesn't match what was sent, compress:"+
+				" %v", compress)
+		}
+		checkNothingSaved(t, receiverDir)
+	}
+}
+
+func TestTransferEmptyStream(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+
+	out := new(bytes.Buffer)
+	res := runSession(t, session{
+		paths: []string{io.StdinPath},
+		stdin: []byte{},
+		out:   out,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	if out.Len() != 0 {
+		t.Fatalf("received %d bytes, want 0", out.Len())
+	}
+	checkNothingSaved(t, receiverDir)
+}
+
+func TestTransferFilesToStdout(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	if err := os.Mkdir(filepath.Join(senderDir, "dir"), 0755); err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	a := writeTestFile(t, senderDir, "a.bin", 4096)
+	b := writeTestFile(t, senderDir, "b.bin", 0)
+	c := writeTestFile(t, senderDir, "dir/c.bin", 8192)
+
+	// Each file's contents are written one after the other, and directories
+	// are left out.
+	out := new(bytes.Buffer)
+	res := runSession(t, session{
+		paths: []string{"a.bin", "b.bin", "dir"},
+		out:   out,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	want := append(append(append([]byte{}, a...), b...), c...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatal("received files don't match what was sent")
+	}
+	checkNothingSaved(t, receiverDir)
+}
+
+func TestTransferInParallel(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	// Doesn't split evenly, so the last range is longer than the others.
+	const size = minParallelSize + 12345
+	want := writeTestFile(t, senderDir, "a.bin", size)
+
+	res := runSession(t, session{
+		paths:      []string{"a.bin"},
+		numStreams: 3,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	checkReceivedFile(t, receiverDir, "a.bin", want)
+	checkNoPartialFiles(t, receiverDir)
+	// Each range is written where it belongs in the file by whichever
+	// connection it arrived on, so the first connection only carries a third
+	// of it.
+	if res.sent >= size/2 {
+		t.Fatalf("sender sent %d bytes over its first connection, want about"+
+			" %d", res.sent, size/3)
+	}
+}
+
+func TestTransferInParallelWithSlowRehash(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	want := writeTestFile(t, senderDir, "a.bin", 2*minRehashRate)
+
+	// The receiver takes longer to read the file back than the sender would
+	// normally wait for it, but the sender waits longer for big files.
+	testHookRehash = func() { time.Sleep(1500 * time.Millisecond) }
+	defer func() { testHookRehash = nil }()
+	res := runSession(t, session{
+		paths:           []string{"a.bin"},
+		numStreams:      2,
+		timeoutDuration: 1,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	checkReceivedFile(t, receiverDir, "a.bin", want)
+}
+
+func TestTransferDeclined(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	writeTestFile(t, senderDir, "a.bin", 4096)
+
+	res := runSession(t, session{
+		paths:        []string{"a.bin"},
+		numStreams:   2,
+		confirmation: "n",
+	}, senderDir, receiverDir)
+	if !errors.Is(res.recvErr, ErrDeclined) {
+		t.Fatalf("unexpected error receiving, got: %v\nwant: %v", res.recvErr,
+			ErrDeclined)
+	}
+	// The receiver tells the sender why it gave up in an error frame.
+	if res.sendErr == nil ||
+		!strings.Contains(res.sendErr.Error(), ErrDeclined.Error()) {
+		t.Fatalf("unexpected error sending, got: %v\nwant: %v", res.sendErr,
+			ErrDeclined)
+	}
+	if _, err := os.Stat(filepath.Join(receiverDir, "a.bin")); err == nil {
+		t.Fatal("declined file was saved")
+	}
+	checkNoPartialFiles(t, receiverDir)
+}
+
+func TestTransferDirectoryOverOnePort(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	if err := os.Mkdir(filepath.Join(senderDir, "dir"), 0755); err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	wantA := writeTestFile(t, senderDir, "dir/a.bin", minParallelSize)
+	wantB := bytes.Repeat([]byte("compressible "), 1000)
+	err := ioutil.WriteFile(filepath.Join(senderDir, "dir", "b.txt"), wantB,
+		0644)
+	if err != nil {
+		t.Fatalf("unexpected error writing b.txt: %v", err)
+	}
+
+	// Every connection is accepted on the listener that the first one came
+	// in on, and the extra ones join the session before they're upgraded to
+	// TLS.
+	res := runSession(t, session{
+		paths:      []string{"dir"},
+		compress:   true,
+		numStreams: 4,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	checkReceivedFile(t, receiverDir, "dir/a.bin", wantA)
+	checkReceivedFile(t, receiverDir, "dir/b.txt", wantB)
+	checkNoPartialFiles(t, receiverDir)
+}
+
+func TestTransferWithDelayedConfirmation(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	want := writeTestFile(t, senderDir, "a.bin", 4096)
+
+	// The user takes longer to accept the transfer than the certificates
+	// last, so every connection has to be established before they're asked.
+	res := runSession(t, session{
+		paths:             []string{"a.bin"},
+		numStreams:        3,
+		confirmation:      "y",
+		confirmationDelay: 3 * time.Second,
+		certLifetime:      2 * time.Second,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	checkReceivedFile(t, receiverDir, "a.bin", want)
+}
+
+func TestTransferIgnoresStrangers(t *testing.T) {
+	senderDir, receiverDir := tempDirs(t)
+	want := writeTestFile(t, senderDir, "a.bin", 4096)
+
+	// The strangers are accepted while the receiver waits for the sender's
+	// other connections, and hung up on.
+	res := runSession(t, session{
+		paths:      []string{"a.bin"},
+		numStreams: 2,
+		strangers:  2,
+	}, senderDir, receiverDir)
+	checkSucceeded(t, res)
+	checkReceivedFile(t, receiverDir, "a.bin", want)
+}
@@ -0,0 +1,284 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	_io "io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/nchaloult/lancp/pkg/io"
+)
+
+// stdinName is the name that data piped into lancp's stdin is sent under.
+const stdinName = "stdin"
+
+// Every type of entry that can be in a manifest, as they're encoded.
+const (
+	entryTypeFile byte = iota
+	entryTypeDir
+	entryTypeStream
+)
+
+// TODO: Is this an okay size? How long could a path ever get?
+// https://www.ibm.com/support/knowledgecenter/SSEQVQ_8.1.10/client/c_cmd_filespecsyntax.html
+const maxPathLen = 4096
+
+// Entry describes one file or directory that's part of a transfer.
+type Entry struct {
+	// Path is the entry's path, always with forward slashes as separators. Its
+	// first element is the base name of one of the files or directories that
+	// the user asked to send.
+	Path string
+
+	// Size is the number of bytes in the entry's contents. Always 0 for
+	// directories, and -1 for streams.
+	Size int64
+
+	// IsDir is true if the entry is a directory.
+	IsDir bool
+
+	// IsStream is true if the entry's contents are read from a stream, like
+	// stdin, whose size isn't known ahead of time.
+	IsStream bool
+
+	// Hash is the SHA-256 digest of the entry's contents. Always the zero
+	// value for directories and streams.
+	Hash [sha256.Size]byte
+
+	// localPath is where the entry lives on the sender's machine. It's never
+	// sent to the receiver.
+	localPath string
+}
+
+// Manifest lists every file and directory that's part of a transfer. Parent
+// directories always come before their contents.
+type Manifest []Entry
+
+// TotalSize returns the sum of the sizes of every entry in the manifest. If the
+// manifest has a stream in it, then the total size isn't known ahead of time,
+// and it returns -1.
+func (m Manifest) TotalSize() int64 {
+	var total int64
+	for _, entry := range m {
+		if entry.IsStream {
+			return -1
+		}
+		total += entry.Size
+	}
+	return total
+}
+
+// BuildManifest walks each file or directory at the provided paths, and
+// returns a manifest with an entry for each of them and, for directories,
+// everything beneath them. Anything that isn't a regular file or a directory,
+// like a symlink, is skipped.
+//
+// If one of the paths is io.StdinPath, the manifest gets a stream entry for
+// whatever is piped into lancp's stdin.
+//
+// Every path must have a different base name, since that's the name the
+// receiver will save it under.
+func BuildManifest(roots ...string) (Manifest, error) {
+	var manifest Manifest
+	rootPaths := make(map[string]string)
+	for _, root := range roots {
+		if root == io.StdinPath {
+			if _, ok := rootPaths[stdinName]; ok {
+				return nil, errors.New("can't send stdin more than once")
+			}
+			rootPaths[stdinName] = root
+			manifest = append(manifest, Entry{
+				Path:      stdinName,
+				Size:      -1,
+				IsStream:  true,
+				localPath: io.StdinPath,
+			})
+			continue
+		}
+
+		// Resolve paths like "." and ".." so they have a meaningful base name.
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		rootName := filepath.Base(absRoot)
+		if other, ok := rootPaths[rootName]; ok {
+			return nil, fmt.Errorf("can't send both %s and %s, since they"+
+				" have the same name", other, root)
+		}
+		rootPaths[rootName] = root
+
+		entries, err := walk(root, rootName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk %s: %v", root, err)
+		}
+		manifest = append(manifest, entries...)
+	}
+
+	return manifest, nil
+}
+
+// walk returns an entry for the file or directory at root and everything
+// beneath it. Each entry's path begins with rootName.
+func walk(root, rootName string) (Manifest, error) {
+	var manifest Manifest
+	err := filepath.Walk(root, func(
+		localPath string,
+		info os.FileInfo,
+		err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, localPath)
+		if err != nil {
+			return err
+		}
+		entry := Entry{
+			Path:      path.Join(rootName, filepath.ToSlash(relPath)),
+			IsDir:     info.IsDir(),
+			localPath: localPath,
+		}
+		// The receiver would refuse the whole transfer, so let the user know
+		// which file is the problem up front.
+		if err = validatePath(entry.Path); err != nil {
+			return fmt.Errorf("can't send %s: %v", localPath, err)
+		}
+		if !entry.IsDir {
+			entry.Size = info.Size()
+			if entry.Hash, err = hashFile(localPath); err != nil {
+				return err
+			}
+		}
+		manifest = append(manifest, entry)
+
+		return nil
+	})
+
+	return manifest, err
+}
+
+// hashFile returns the SHA-256 digest of the contents of the file at the
+// provided path.
+func hashFile(localPath string) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	f, err := os.Open(localPath)
+	if err != nil {
+		return digest, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = _io.Copy(h, f); err != nil {
+		return digest, err
+	}
+	copy(digest[:], h.Sum(nil))
+
+	return digest, nil
+}
+
+// encodeManifest encodes the provided manifest into the payload of a manifest
+// frame.
+//
+// A manifest is encoded as the number of entries it has, followed by each
+// entry. Each entry is encoded as a byte for its type, the length of its path,
+// its path, its size, and, for files, its hash.
+func encodeManifest(manifest Manifest) []byte {
+	w := new(bytes.Buffer)
+	// Combo of answers from https://stackoverflow.com/questions/35371385/how-can-i-convert-an-int64-into-a-byte-array-in-go
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(manifest)))
+	w.Write(buf[:n])
+	for _, entry := range manifest {
+		entryType := entryTypeFile
+		if entry.IsDir {
+			entryType = entryTypeDir
+		} else if entry.IsStream {
+			entryType = entryTypeStream
+		}
+		w.WriteByte(entryType)
+		n = binary.PutUvarint(buf, uint64(len(entry.Path)))
+		w.Write(buf[:n])
+		w.WriteString(entry.Path)
+		n = binary.PutVarint(buf, entry.Size)
+		w.Write(buf[:n])
+		if entryType == entryTypeFile {
+			w.Write(entry.Hash[:])
+		}
+	}
+
+	return w.Bytes()
+}
+
+// decodeManifest decodes the payload of a manifest frame. See encodeManifest
+// for how manifests are encoded.
+func decodeManifest(payload []byte) (Manifest, error) {
+	r := bytes.NewReader(payload)
+	numEntries, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read number of entries: %v", err)
+	}
+
+	// Don't trust numEntries enough to preallocate with it.
+	var manifest Manifest
+	for i := uint64(0); i < numEntries; i++ {
+		entryType, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry type: %v", err)
+		}
+		if entryType > entryTypeStream {
+			return nil, fmt.Errorf("got unknown entry type %d", entryType)
+		}
+		pathLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read path length: %v", err)
+		}
+		if pathLen > maxPathLen {
+			return nil, fmt.Errorf("path is %d bytes long, max is %d",
+				pathLen, maxPathLen)
+		}
+		pathBuf := make([]byte, pathLen)
+		if _, err = _io.ReadFull(r, pathBuf); err != nil {
+			return nil, fmt.Errorf("failed to read path: %v", err)
+		}
+		if err = validatePath(string(pathBuf)); err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read size: %v", err)
+		}
+		if size < 0 && !(entryType == entryTypeStream && size == -1) {
+			return nil, fmt.Errorf("got negative size %d for %s",
+				size, pathBuf)
+		}
+
+		entry := Entry{
+			Path:     string(pathBuf),
+			Size:     size,
+			IsDir:    entryType == entryTypeDir,
+			IsStream: entryType == entryTypeStream,
+		}
+		if entryType == entryTypeFile {
+			if _, err = _io.ReadFull(r, entry.Hash[:]); err != nil {
+				return nil, fmt.Errorf("failed to read hash: %v", err)
+			}
+		}
+		manifest = append(manifest, entry)
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("got %d unexpected bytes after the last entry",
+			r.Len())
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,142 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	tests := []Manifest{
+		{},
+		{{Path: "a.txt", Size: 42, Hash: [32]byte{4, 2}}},
+		{
+			{Path: "build", IsDir: true},
+			{Path: "build/empty", IsDir: true},
+			{Path: "build/main", Size: 8675309, Hash: [32]byte{31: 0xff}},
+			{Path: "build/docs/README.md", Size: 0},
+			{Path: "stdin", Size: -1, IsStream: true},
+		},
+	}
+
+	for _, want := range tests {
+		got, err := decodeManifest(encodeManifest(want))
+		if err != nil {
+			t.Fatalf("unexpected error decoding manifest: %v", err)
+		}
+
+		if len(got) != len(want) ||
+			(len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Fatalf("unexpected result, got: %+v\nwant: %+v", got, want)
+		}
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp-manifest")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	makeTree(t, dir, "one/a.txt", "one/b.txt", "two/a.txt", "two/empty/",
+		"two/sub/deeper/c.txt")
+
+	tests := []struct {
+		roots   []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"one/a.txt"}, []string{"a.txt 5"}, false},
+		{[]string{"one/b.txt", "two/a.txt", "two/sub"}, []string{
+			"b.txt 5",
+			"a.txt 5",
+			"sub/",
+			"sub/deeper/",
+			"sub/deeper/c.txt 5",
+		}, false},
+		{[]string{"two"}, []string{
+			"two/",
+			"two/a.txt 5",
+			"two/empty/",
+			"two/sub/",
+			"two/sub/deeper/",
+			"two/sub/deeper/c.txt 5",
+		}, false},
+		{[]string{"one", "two/sub/deeper"}, []string{
+			"one/",
+			"one/a.txt 5",
+			"one/b.txt 5",
+			"deeper/",
+			"deeper/c.txt 5",
+		}, false},
+		// Both would be saved as a.txt.
+		{[]string{"one/a.txt", "two/a.txt"}, nil, true},
+		{[]string{"two/sub", "one/../two/sub"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		var roots []string
+		for _, root := range tt.roots {
+			roots = append(roots, filepath.Join(dir, root))
+		}
+		manifest, err := BuildManifest(roots...)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("expected an error building manifest for %v, got nil",
+					tt.roots)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error building manifest for %v: %v",
+				tt.roots, err)
+		}
+
+		if got := listEntries(manifest); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("unexpected result for %v, got: %q\nwant: %q", tt.roots,
+				got, tt.want)
+		}
+	}
+}
+
+// makeTree creates each of the provided paths beneath dir. Paths that end in a
+// slash are created as directories, and every other path is created as a file
+// that contains its own name.
+func makeTree(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		localPath := filepath.Join(dir, filepath.FromSlash(path))
+		if strings.HasSuffix(path, "/") {
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				t.Fatalf("unexpected error creating %s: %v", path, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatalf("unexpected error creating %s: %v", path, err)
+		}
+		err := ioutil.WriteFile(localPath, []byte(filepath.Base(path)), 0644)
+		if err != nil {
+			t.Fatalf("unexpected error writing %s: %v", path, err)
+		}
+	}
+}
+
+// listEntries returns the path of each of the manifest's entries, followed by
+// a slash for directories, or by a space and its size for files.
+func listEntries(manifest Manifest) []string {
+	var list []string
+	for _, entry := range manifest {
+		if entry.IsDir {
+			list = append(list, entry.Path+"/")
+		} else {
+			list = append(list, fmt.Sprintf("%s %d", entry.Path, entry.Size))
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,372 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	_io "io"
+	_net "net"
+	"os"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/io"
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+const (
+	// MaxStreams is the most connections that files' contents can be sent
+	// over at the same time.
+	MaxStreams = 16
+
+	// minParallelSize is the fewest bytes that a file must have left to send
+	// for it to be split up and sent over several connections. Smaller files
+	// aren't worth the trouble.
+	minParallelSize = 8 << 20
+
+	// streamTokenLen is the number of bytes in the random token that ties
+	// extra connections to the session that they're a part of.
+	streamTokenLen = 16
+
+	// journalInterval is how often the journal of a file that's being
+	// received over several connections is updated.
+	journalInterval = time.Second
+
+	// minRehashRate is the slowest, in bytes per second, that we expect the
+	// receiver to read back a file that it received over several connections
+	// to check its digest. It's roughly what a slow hard drive can manage.
+	minRehashRate = 16 << 20
+)
+
+// testHookRehash, if it isn't nil, is called right before the receiver reads
+// back a file that it received over several connections.
+var testHookRehash func()
+
+// stream is one of the connections that files' contents are sent over.
+type stream struct {
+	conn _net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	fr   *net.FrameReader
+}
+
+func newStream(conn _net.Conn) *stream {
+	r := bufio.NewReader(conn)
+	return &stream{conn, r, bufio.NewWriter(conn), net.NewFrameReader(r)}
+}
+
+// fileRange is a part of a file that's sent over one connection.
+type fileRange struct {
+	offset int64
+	length int64
+}
+
+// splitRanges splits the part of the provided entry after offset into one
+// range for each of numStreams connections. Returns nil if it isn't worth
+// splitting up, or can't be split up because it's a stream.
+//
+// The sender and receiver both call this to agree on which range is sent over
+// which connection, so it must always split an entry the same way.
+func splitRanges(entry Entry, offset int64, numStreams int) []fileRange {
+	remaining := entry.Size - offset
+	if entry.IsStream || numStreams < 2 || remaining < minParallelSize {
+		return nil
+	}
+
+	ranges := make([]fileRange, numStreams)
+	rangeLen := remaining / int64(numStreams)
+	for i := range ranges {
+		ranges[i] = fileRange{offset + int64(i)*rangeLen, rangeLen}
+	}
+	// The last range picks up whatever is left over.
+	ranges[numStreams-1].length = remaining - int64(numStreams-1)*rangeLen
+
+	return ranges
+}
+
+// encodeStreams encodes the provided number of connections and a new random
+// token into the payload of a streams frame. The same payload is sent at the
+// beginning of each extra connection, so the receiver can tell that it's part
+// of this session.
+func encodeStreams(numStreams int) ([]byte, error) {
+	payload := make([]byte, streamTokenLen)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(numStreams))
+
+	return append(payload, buf[:n]...), nil
+}
+
+// decodeStreams decodes the payload of a streams frame, and returns the number
+// of connections in it. See encodeStreams for how it's encoded.
+func decodeStreams(payload []byte) (int, error) {
+	if len(payload) < streamTokenLen {
+		return 0, fmt.Errorf("got %d byte streams frame, want at least %d"+
+			" bytes", len(payload), streamTokenLen)
+	}
+	r := bytes.NewReader(payload[streamTokenLen:])
+	numStreams, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read number of streams: %v", err)
+	}
+	if numStreams < 1 || numStreams > MaxStreams || r.Len() > 0 {
+		return 0, fmt.Errorf("got %d streams, want between 1 and %d",
+			numStreams, MaxStreams)
+	}
+
+	return int(numStreams), nil
+}
+
+// dialExtraStreams opens numStreams more connections with dial, and sends the
+// provided streams frame payload over each of them.
+func dialExtraStreams(
+	dial func() (*stream, error),
+	numStreams int,
+	payload []byte,
+) ([]*stream, error) {
+	var streams []*stream
+	for i := 0; i < numStreams; i++ {
+		s, err := dial()
+		if err != nil {
+			closeStreams(streams)
+			return nil, err
+		}
+		streams = append(streams, s)
+
+		err = net.WriteFrame(s.w, net.FrameStreams, payload)
+		if err == nil {
+			err = s.w.Flush()
+		}
+		if err != nil {
+			closeStreams(streams)
+			return nil, err
+		}
+	}
+
+	return streams, nil
+}
+
+// acceptExtraStreams accepts numStreams more connections with accept, and
+// checks that each of them begins with the provided streams frame payload.
+//
+// timeoutDuration is in seconds.
+func acceptExtraStreams(
+	accept func() (*stream, error),
+	numStreams int,
+	payload []byte,
+	timeoutDuration uint,
+) ([]*stream, error) {
+	var streams []*stream
+	for i := 0; i < numStreams; i++ {
+		s, err := accept()
+		if err != nil {
+			closeStreams(streams)
+			return nil, err
+		}
+		streams = append(streams, s)
+
+		err = readWithTimeout(s.conn, timeoutDuration, func() error {
+			frame, err := s.fr.ExpectFrame(net.FrameStreams)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(frame.Payload, payload) {
+				return errors.New("got a connection that isn't part of this" +
+					" session")
+			}
+			return nil
+		})
+		if err != nil {
+			closeStreams(streams)
+			return nil, err
+		}
+	}
+
+	return streams, nil
+}
+
+// expectJoin checks that the provided connection, which was just accepted,
+// begins with a join frame, which means that it's one of the extra connections
+// that the sender opens to send files' contents over. Nothing after that frame
+// is read, so the connection can be upgraded to TLS afterwards.
+//
+// timeoutDuration is in seconds.
+func expectJoin(conn _net.Conn, timeoutDuration uint) error {
+	return readWithTimeout(conn, timeoutDuration, func() error {
+		_, err := net.NewFrameReader(conn).ExpectFrame(net.FrameJoin)
+		return err
+	})
+}
+
+func closeStreams(streams []*stream) {
+	for _, s := range streams {
+		s.conn.Close()
+	}
+}
+
+// sendFileInParallel sends each of the provided ranges of f over the stream
+// with the same index, all at the same time. Each range's contents are
+// followed by a digest frame with the SHA-256 digest of that range.
+func sendFileInParallel(
+	f *os.File,
+	ranges []fileRange,
+	streams []*stream,
+	bar *io.ProgressBar,
+	compress bool,
+) error {
+	return runConcurrently(len(ranges), func(i int) error {
+		h := sha256.New()
+		section := _io.NewSectionReader(f, ranges[i].offset, ranges[i].length)
+		src := _io.TeeReader(bar.Track(section), h)
+		w := streams[i].w
+		err := sendContents(src, ranges[i].length, compress, w)
+		if err == nil {
+			err = net.WriteFrame(w, net.FrameDigest, h.Sum(nil))
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		return err
+	}, func() {
+		closeStreams(streams[1:])
+	})
+}
+
+// receiveFileInParallel receives each of the provided ranges of the provided
+// entry from the stream with the same index, all at the same time, and writes
+// them to the same place in f. See sendFileInParallel for how they're sent.
+// Once every range has arrived, it checks that the whole file's SHA-256 digest
+// matches the one in the manifest.
+//
+// Since ranges arrive out of order, it keeps track of how much of the file has
+// arrived in the file's journal. If it fails, the bytes before the first range
+// that didn't fully arrive are kept, so that the transfer can be resumed from
+// there.
+//
+// Returns the number of bytes that were received.
+func receiveFileInParallel(
+	entry Entry,
+	f *os.File,
+	ranges []fileRange,
+	streams []*stream,
+	bar *io.ProgressBar,
+	compress bool,
+) (int64, error) {
+	writers := make([]*io.SectionWriter, len(ranges))
+	for i, r := range ranges {
+		writers[i] = io.NewSectionWriter(f, r.offset)
+	}
+	if err := markRangedPartialFile(entry, ranges[0].offset); err != nil {
+		return 0, err
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(journalInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				markRangedPartialFile(entry,
+					getReceivedPrefix(ranges, writers))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := runConcurrently(len(ranges), func(i int) error {
+		h := sha256.New()
+		_, err := receiveContents(writers[i], ranges[i].length, h, bar,
+			compress, streams[i].fr)
+		if err != nil {
+			return err
+		}
+		return checkDigest(h, streams[i].fr)
+	}, func() {
+		closeStreams(streams[1:])
+	})
+	// Make sure the journal isn't updated again after this returns.
+	close(done)
+	<-stopped
+	if err != nil {
+		received := getReceivedPrefix(ranges, writers)
+		f.Truncate(received)
+		markRangedPartialFile(entry, received)
+		return 0, err
+	}
+
+	// Every range's digest matched, but make sure they add up to the file
+	// that the sender meant to send.
+	if testHookRehash != nil {
+		testHookRehash()
+	}
+	h := sha256.New()
+	if _, err = f.Seek(0, _io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err = _io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	var got [sha256.Size]byte
+	copy(got[:], h.Sum(nil))
+	if got != entry.Hash {
+		return 0, fmt.Errorf("%w: file changed on the sender's machine while"+
+			" it was being sent", errCorrupted)
+	}
+
+	return ranges[len(ranges)-1].offset + ranges[len(ranges)-1].length -
+		ranges[0].offset, nil
+}
+
+// getVerifyTimeout returns how long, in seconds, the sender should wait for the
+// receiver to confirm that every file arrived intact, given rehashSize, the
+// number of bytes in the files that were sent over several connections. The
+// receiver reads each of those back to check its digest, which can take a lot
+// longer than timeoutDuration for big files.
+func getVerifyTimeout(timeoutDuration uint, rehashSize int64) uint {
+	return timeoutDuration +
+		uint((rehashSize+minRehashRate-1)/minRehashRate)
+}
+
+// getReceivedPrefix returns the number of bytes at the beginning of a file that
+// were fully received, given the ranges that it was split into and the writers
+// that wrote each of them.
+func getReceivedPrefix(ranges []fileRange, writers []*io.SectionWriter) int64 {
+	for i, r := range ranges {
+		if writers[i].Offset() < r.offset+r.length {
+			return writers[i].Offset()
+		}
+	}
+	last := ranges[len(ranges)-1]
+	return last.offset + last.length
+}
+
+// runConcurrently calls run n times at the same time, with each number from 0
+// to n-1, and waits for all of them to return. If any of them return an error,
+// abort is called once so that the rest can give up early, and the first error
+// is returned.
+func runConcurrently(n int, run func(i int) error, abort func()) error {
+	errChan := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errChan <- run(i)
+		}(i)
+	}
+
+	var firstErr error
+	for i := 0; i < n; i++ {
+		if err := <-errChan; err != nil && firstErr == nil {
+			firstErr = err
+			abort()
+		}
+	}
+
+	return firstErr
+}
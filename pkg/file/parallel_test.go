@@ -0,0 +1,40 @@
+package file
+
+import "testing"
+
+func TestSplitRanges(t *testing.T) {
+	tests := []struct {
+		size, offset int64
+		numStreams   int
+		wantRanges   int
+	}{
+		{minParallelSize - 1, 0, 4, 0},
+		{minParallelSize, 0, 1, 0},
+		{minParallelSize, 0, 4, 4},
+		{minParallelSize*3 + 7, minParallelSize, 3, 3},
+		{minParallelSize*3 + 7, minParallelSize*2 + 8, 3, 0},
+	}
+
+	for _, test := range tests {
+		entry := Entry{Path: "a.bin", Size: test.size}
+		ranges := splitRanges(entry, test.offset, test.numStreams)
+		if len(ranges) != test.wantRanges {
+			t.Fatalf("unexpected number of ranges for %+v, got: %d\nwant: %d",
+				test, len(ranges), test.wantRanges)
+		}
+
+		// Ranges must cover everything after offset, in order, without any
+		// gaps or overlaps.
+		next := test.offset
+		for _, r := range ranges {
+			if r.offset != next || r.length <= 0 {
+				t.Fatalf("unexpected ranges for %+v, got: %+v", test, ranges)
+			}
+			next += r.length
+		}
+		if len(ranges) > 0 && next != test.size {
+			t.Fatalf("ranges for %+v end at %d, want %d",
+				test, next, test.size)
+		}
+	}
+}
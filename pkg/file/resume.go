@@ -0,0 +1,227 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Partially-received files are saved in the receiver's current directory under
+// a name derived from their path, size, and hash, alongside a journal that
+// describes which file they're a part of. If a transfer is interrupted, these
+// are left behind so the next transfer of the same file can pick up where this
+// one left off.
+const (
+	partialFilePrefix = ".lancp-"
+	partialFileSuffix = ".part"
+	journalSuffix     = ".journal"
+)
+
+// journal describes the file that a partially-received file is a part of.
+type journal struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+
+	// Ranged is true if the file is being received over several connections
+	// at once. If it is, its size on disk doesn't say how much of it has been
+	// received, so Received does instead.
+	Ranged bool `json:"ranged,omitempty"`
+
+	// Received is the number of bytes at the beginning of the file that are
+	// known to have been received. Only set if Ranged is true.
+	Received int64 `json:"received,omitempty"`
+}
+
+// getPartialPaths returns the paths of the partially-received file and journal
+// for the provided entry.
+func getPartialPaths(entry Entry) (partialPath, journalPath string) {
+	// Two files with the same contents could be part of the same transfer, so
+	// the hash alone isn't unique enough.
+	j := newJournal(entry)
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s",
+		j.Path, j.Size, j.Hash)))
+	partialPath = partialFilePrefix + hex.EncodeToString(key[:16]) +
+		partialFileSuffix
+	return partialPath, partialPath + journalSuffix
+}
+
+// getResumeOffset returns the number of bytes of the provided entry that were
+// received in an earlier, interrupted transfer. Returns 0 if there isn't a
+// partially-received file whose journal matches the entry's path, size, and
+// hash. Streams can't be resumed, so it always returns 0 for them.
+func getResumeOffset(entry Entry) int64 {
+	if entry.IsStream {
+		return 0
+	}
+	partialPath, journalPath := getPartialPaths(entry)
+	journalBytes, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		return 0
+	}
+	var j journal
+	if err = json.Unmarshal(journalBytes, &j); err != nil {
+		return 0
+	}
+	want := newJournal(entry)
+	if j.Path != want.Path || j.Size != want.Size || j.Hash != want.Hash {
+		return 0
+	}
+
+	info, err := os.Stat(partialPath)
+	if err != nil {
+		return 0
+	}
+	received := info.Size()
+	if j.Ranged {
+		received = min(received, j.Received)
+	}
+	return min(received, entry.Size)
+}
+
+// openPartialFile writes a journal for the provided entry, then opens its
+// partially-received file for writing, discarding anything past offset. The
+// first offset bytes of the file are written to h, so that it can go on to
+// hash the rest of the file as it's received.
+func openPartialFile(
+	entry Entry,
+	offset int64,
+	h hash.Hash,
+) (*os.File, error) {
+	if err := writeJournal(entry, newJournal(entry)); err != nil {
+		return nil, err
+	}
+
+	partialPath, _ := getPartialPaths(entry)
+	if err := ensureNotSymlink(partialPath); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Leaves the file's offset at the end of the file.
+	if _, err = io.CopyN(h, file, offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// markRangedPartialFile updates the provided entry's journal to say that it's
+// being received over several connections at once, and that the first received
+// bytes of it have arrived.
+func markRangedPartialFile(entry Entry, received int64) error {
+	j := newJournal(entry)
+	j.Ranged = true
+	j.Received = received
+	return writeJournal(entry, j)
+}
+
+func writeJournal(entry Entry, j journal) error {
+	_, journalPath := getPartialPaths(entry)
+	journalBytes, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err = ensureNotSymlink(journalPath); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(journalPath, journalBytes, 0666); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+
+	return nil
+}
+
+// completePartialFile moves the provided entry's partially-received file, which
+// should now be complete, to localPath, and removes its journal.
+func completePartialFile(entry Entry, localPath string) error {
+	partialPath, journalPath := getPartialPaths(entry)
+	if err := os.Rename(partialPath, localPath); err != nil {
+		return err
+	}
+
+	return os.Remove(journalPath)
+}
+
+// discardPartialFile deletes the provided entry's partially-received file and
+// its journal.
+func discardPartialFile(entry Entry) {
+	partialPath, journalPath := getPartialPaths(entry)
+	os.Remove(partialPath)
+	os.Remove(journalPath)
+}
+
+func newJournal(entry Entry) journal {
+	return journal{
+		Path: entry.Path,
+		Size: entry.Size,
+		Hash: hex.EncodeToString(entry.Hash[:]),
+	}
+}
+
+// encodeOffsets encodes the provided offsets into the payload of an offsets
+// frame. Offsets are encoded as the number of offsets, followed by each offset.
+func encodeOffsets(offsets []int64) []byte {
+	w := new(bytes.Buffer)
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(offsets)))
+	w.Write(buf[:n])
+	for _, offset := range offsets {
+		n = binary.PutVarint(buf, offset)
+		w.Write(buf[:n])
+	}
+
+	return w.Bytes()
+}
+
+// decodeOffsets decodes the payload of an offsets frame, checking that there's
+// one offset for each file in the provided manifest, and that each offset is
+// within its file. See encodeOffsets for how offsets are encoded.
+func decodeOffsets(payload []byte, manifest Manifest) ([]int64, error) {
+	r := bytes.NewReader(payload)
+	numOffsets, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read number of offsets: %v", err)
+	}
+
+	offsets := make([]int64, 0, len(manifest))
+	for _, entry := range manifest {
+		if entry.IsDir {
+			continue
+		}
+		if uint64(len(offsets)) == numOffsets {
+			return nil, fmt.Errorf("got %d offsets, want one per file",
+				numOffsets)
+		}
+
+		offset, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read offset: %v", err)
+		}
+		if entry.IsStream && offset != 0 ||
+			!entry.IsStream && (offset < 0 || offset > entry.Size) {
+			return nil, fmt.Errorf("got offset %d for %s, which is %d bytes",
+				offset, entry.Path, entry.Size)
+		}
+		offsets = append(offsets, offset)
+	}
+	if uint64(len(offsets)) != numOffsets || r.Len() > 0 {
+		return nil, fmt.Errorf("got %d offsets, want one per file", numOffsets)
+	}
+
+	return offsets, nil
+}
@@ -0,0 +1,106 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// windowsReservedNames are names that Windows treats as devices instead of
+// files, even with an extension, like "nul.txt".
+var windowsReservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// validatePath returns an error if the provided entry path isn't safe for the
+// receiver to save something under. Every element of the path must be a safe
+// name (see validateName), so the path can't be absolute, and can't climb out
+// of the directory that it's saved in.
+//
+// Unsafe paths are rejected instead of being rewritten into something safe, so
+// that nothing is ever saved somewhere that the sender didn't ask for.
+func validatePath(entryPath string) error {
+	for _, elem := range strings.Split(entryPath, "/") {
+		if err := validateName(elem); err != nil {
+			return fmt.Errorf("unsafe path %q: %v",
+				sanitizeForTerminal(entryPath), err)
+		}
+	}
+	return nil
+}
+
+// validateName returns an error if the provided name isn't safe to use as a
+// single element of a path on any operating system.
+func validateName(name string) error {
+	switch name {
+	case "":
+		return errors.New("empty name")
+	case ".", "..":
+		return fmt.Errorf("%q isn't a name", name)
+	}
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\':
+			return errors.New("name has a path separator in it")
+		case r == ':':
+			// Windows treats "C:name" as a path on another drive, and
+			// "name:stream" as part of a file.
+			return errors.New("name has a colon in it")
+		case unicode.IsControl(r):
+			return errors.New("name has a control character in it")
+		}
+	}
+	base := strings.ToLower(strings.SplitN(name, ".", 2)[0])
+	if windowsReservedNames[strings.TrimRight(base, " ")] {
+		return fmt.Errorf("%q is reserved on Windows", name)
+	}
+
+	return nil
+}
+
+// makeDirsBeneath creates each of the provided directories inside the one
+// before it, starting inside root, unless they already exist. It makes sure
+// that none of them are symlinks, so that nothing beneath them can end up
+// outside of root. Returns the path of the last directory.
+func makeDirsBeneath(root string, dirs []string) (string, error) {
+	dir := root
+	for _, name := range dirs {
+		dir = filepath.Join(dir, name)
+		if err := os.Mkdir(dir, 0777); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s isn't a directory", dir)
+		}
+	}
+
+	return dir, nil
+}
+
+// ensureNotSymlink returns an error if there's a symlink at the provided path,
+// so that writing to it can't write somewhere else.
+func ensureNotSymlink(localPath string) error {
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symlink", localPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidatePath(t *testing.T) {
+	for _, entryPath := range []string{
+		"a.txt",
+		"build/docs/README.md",
+		".hidden",
+		"..dots",
+		"console.log",
+		"com10",
+		"résumé.pdf",
+	} {
+		if err := validatePath(entryPath); err != nil {
+			t.Fatalf("unexpected error validating %q: %v", entryPath, err)
+		}
+	}
+}
+
+func TestValidatePathRejectsUnsafePaths(t *testing.T) {
+	for _, entryPath := range []string{
+		"",
+		".",
+		"..",
+		"../../.bashrc",
+		"build/../../.bashrc",
+		"/etc/passwd",
+		"build//main",
+		"build/",
+		`..\..\.bashrc`,
+		`C:\Windows`,
+		"C:foo",
+		"file.txt:stream",
+		"bad\x00name",
+		"bell\a",
+		"line\nbreak",
+		"CON",
+		"nul.txt",
+		"build/Lpt1",
+		"aux .txt",
+	} {
+		if err := validatePath(entryPath); err == nil {
+			t.Fatalf("expected an error validating %q", entryPath)
+		}
+	}
+}
+
+func TestDecodeManifestRejectsUnsafePaths(t *testing.T) {
+	manifest := Manifest{{Path: "../../.bashrc", Size: 4}}
+
+	if _, err := decodeManifest(encodeManifest(manifest)); err == nil {
+		t.Fatal("expected an error decoding a manifest with an unsafe path")
+	}
+}
+
+func TestMakeDirsBeneath(t *testing.T) {
+	root, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	dir, err := makeDirsBeneath(root, []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("unexpected error making dirs: %v", err)
+	}
+	if want := filepath.Join(root, "a", "b"); dir != want {
+		t.Fatalf("unexpected dir, got: %q\nwant: %q", dir, want)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("expected %s to be a directory", dir)
+	}
+	// Directories that already exist are fine.
+	if _, err = makeDirsBeneath(root, []string{"a", "b"}); err != nil {
+		t.Fatalf("unexpected error making existing dirs: %v", err)
+	}
+}
+
+func TestMakeDirsBeneathRejectsSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err = os.Symlink(outside, filepath.Join(root, "a")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+
+	if _, err = makeDirsBeneath(root, []string{"a", "b"}); err == nil {
+		t.Fatal("expected an error making dirs beneath a symlink")
+	}
+	if _, err = os.Stat(filepath.Join(outside, "b")); !os.IsNotExist(err) {
+		t.Fatal("expected nothing to be created outside of root")
+	}
+}
+
+func TestEnsureNotSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, "link")
+	if err = os.Symlink(filepath.Join(dir, "target"), link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+
+	if err = ensureNotSymlink(filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("unexpected error checking a missing file: %v", err)
+	}
+	if err = ensureNotSymlink(link); err == nil {
+		t.Fatal("expected an error checking a symlink")
+	}
+}
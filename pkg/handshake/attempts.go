@@ -0,0 +1,77 @@
+package handshake
+
+import (
+	_net "net"
+	"time"
+)
+
+const (
+	// DefaultMaxAttempts is the number of attempts that a receiver answers
+	// before it gives up, unless the user asks for something else.
+	DefaultMaxAttempts = 5
+
+	// attemptInterval is how long a receiver waits after answering an attempt
+	// from an address before it answers another one from the same address.
+	attemptInterval = 2 * time.Second
+
+	// confirmationTimeout is how long a receiver waits for a sender to confirm
+	// an attempt that it answered. Senders confirm right away, so anything
+	// that takes longer isn't coming.
+	confirmationTimeout = 5 * time.Second
+)
+
+// attemptLimiter decides which attempts to begin the handshake a receiver
+// answers. Each attempt that's answered is a guess at the passphrase, so it
+// only answers a limited number of them in total, and ignores attempts that
+// come in too quickly from the same address.
+type attemptLimiter struct {
+	// maxAttempts is the number of attempts that are answered in total.
+	maxAttempts int
+
+	// numAttempts is the number of attempts that have been answered so far.
+	numAttempts int
+
+	// interval is how long to wait after answering an attempt from an address
+	// before answering another one from the same address.
+	interval time.Duration
+
+	// lastAttempts maps each IP address that an attempt was answered from to
+	// when the latest one was answered.
+	lastAttempts map[string]time.Time
+}
+
+func newAttemptLimiter(
+	maxAttempts int,
+	interval time.Duration,
+) *attemptLimiter {
+	return &attemptLimiter{
+		maxAttempts:  maxAttempts,
+		interval:     interval,
+		lastAttempts: make(map[string]time.Time),
+	}
+}
+
+// allow returns true if an attempt from the provided address that arrived at
+// the provided time should be answered, and counts it if so.
+func (l *attemptLimiter) allow(addr _net.Addr, now time.Time) bool {
+	if l.exhausted() {
+		return false
+	}
+	// Ports are easy to change, so only the IP address counts.
+	source := addr.String()
+	if udpAddr, ok := addr.(*_net.UDPAddr); ok {
+		source = udpAddr.IP.String()
+	}
+	if last, ok := l.lastAttempts[source]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+
+	l.lastAttempts[source] = now
+	l.numAttempts++
+	return true
+}
+
+// exhausted returns true if no more attempts will be answered.
+func (l *attemptLimiter) exhausted() bool {
+	return l.numAttempts >= l.maxAttempts
+}
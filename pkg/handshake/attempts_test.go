@@ -0,0 +1,52 @@
+package handshake
+
+import (
+	_net "net"
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiterRateLimitsEachSource(t *testing.T) {
+	l := newAttemptLimiter(10, time.Second)
+	now := time.Now()
+	first := &_net.UDPAddr{IP: _net.ParseIP("10.0.0.2"), Port: 6969}
+	samePort := &_net.UDPAddr{IP: _net.ParseIP("10.0.0.2"), Port: 7070}
+	other := &_net.UDPAddr{IP: _net.ParseIP("10.0.0.3"), Port: 6969}
+
+	if !l.allow(first, now) {
+		t.Fatal("expected the first attempt to be allowed")
+	}
+	if l.allow(samePort, now.Add(time.Second/2)) {
+		t.Fatal("expected an attempt from the same IP address too soon" +
+			" after the first to be ignored")
+	}
+	if !l.allow(other, now.Add(time.Second/2)) {
+		t.Fatal("expected an attempt from another IP address to be allowed")
+	}
+	if !l.allow(first, now.Add(time.Second)) {
+		t.Fatal("expected an attempt from the same IP address after the" +
+			" interval to be allowed")
+	}
+}
+
+func TestAttemptLimiterBudget(t *testing.T) {
+	l := newAttemptLimiter(3, 0)
+	addr := &_net.UDPAddr{IP: _net.ParseIP("10.0.0.2"), Port: 6969}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if l.exhausted() {
+			t.Fatalf("expected budget not to be exhausted after %d attempts",
+				i)
+		}
+		if !l.allow(addr, now.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("expected attempt %d to be allowed", i+1)
+		}
+	}
+	if !l.exhausted() {
+		t.Fatal("expected budget to be exhausted")
+	}
+	if l.allow(addr, now.Add(time.Hour)) {
+		t.Fatal("expected attempts past the budget to be ignored")
+	}
+}
@@ -0,0 +1,112 @@
+package handshake
+
+import (
+	"fmt"
+	_net "net"
+	"os"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/mdns"
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// Discovery is a way for a sender to find receivers to begin the handshake
+// with.
+type Discovery int
+
+const (
+	// DiscoveryBroadcast sends the message that begins the handshake to the
+	// broadcast address of every network that the sender is on, and to the
+	// lancp IPv6 multicast group.
+	DiscoveryBroadcast Discovery = iota
+
+	// DiscoveryMDNS looks for receivers that advertise the lancp service over
+	// multicast DNS, and sends the message that begins the handshake to each
+	// of them directly. Works on networks that filter broadcasts.
+	DiscoveryMDNS
+)
+
+const (
+	// serviceName is the DNS-SD service that receivers advertise over
+	// multicast DNS.
+	serviceName = "_lancp._tcp.local"
+
+	// mdnsTimeout is how long a sender waits for receivers to respond to a
+	// multicast DNS query.
+	mdnsTimeout = time.Second
+)
+
+// ParseDiscovery returns the Discovery with the provided name, which is
+// "broadcast" or "mdns".
+func ParseDiscovery(name string) (Discovery, error) {
+	switch name {
+	case "broadcast":
+		return DiscoveryBroadcast, nil
+	case "mdns":
+		return DiscoveryMDNS, nil
+	default:
+		return 0, fmt.Errorf("got discovery %q, want \"broadcast\" or"+
+			" \"mdns\"", name)
+	}
+}
+
+// findReceivers returns the addresses that the message that begins the
+// handshake needs to be sent to, depending on how the sender was asked to
+// find receivers.
+func (c *SenderConductor) findReceivers() ([]*_net.UDPAddr, error) {
+	if c.host != "" {
+		return net.ResolveHostAddrs(c.host, c.port)
+	}
+	if c.discovery != DiscoveryMDNS {
+		addrs, err := net.GetDiscoveryAddrs(c.port, c.ifaceName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build UDP broadcast"+
+				" addresses: %v", err)
+		}
+		return addrs, nil
+	}
+
+	services, err := mdns.Resolve(serviceName, c.ifaceName, mdnsTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for receivers over mDNS: %v",
+			err)
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("no receivers advertised themselves over mDNS"+
+			" within %v", mdnsTimeout)
+	}
+	// Receivers advertise the TCP port that the rest of the session takes
+	// place on, but the handshake happens on our UDP port.
+	port, err := net.GetPortAsInt(c.port)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*_net.UDPAddr
+	for _, service := range services {
+		addrs = append(addrs, &_net.UDPAddr{
+			IP:   service.Addr.IP,
+			Port: port,
+			Zone: service.Addr.Zone,
+		})
+	}
+
+	return addrs, nil
+}
+
+// advertise begins advertising the lancp service over multicast DNS, so that
+// senders can find this receiver even if broadcasts don't reach it. Its SRV
+// record has our TCP port in it. The caller is responsible for closing the
+// returned Responder once the handshake is over.
+func (c *ReceiverConductor) advertise() (*mdns.Responder, error) {
+	portNum, err := net.GetPortAsInt(c.tcpPort)
+	if err != nil {
+		return nil, err
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		name = "lancp"
+	}
+
+	return mdns.Advertise(serviceName, name, portNum,
+		[]string{fmt.Sprintf("protovers=%d", net.ProtocolVersion)})
+}
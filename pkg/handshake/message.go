@@ -0,0 +1,223 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// Capabilities is a set of optional features that a build of lancp supports.
+// Each feature is a single bit, so that builds can advertise features that
+// older builds don't know about without confusing them.
+type Capabilities uint64
+
+// Every optional feature that lancp knows about. New features should only ever
+// be added to the end of this list, so that existing features keep their bits.
+const (
+	// CapabilityCompression means that file contents can be compressed before
+	// they're sent.
+	CapabilityCompression Capabilities = 1 << iota
+
+	// CapabilityMultiStream means that large files can be split into ranges
+	// that are sent over several connections at the same time.
+	CapabilityMultiStream
+)
+
+// SupportedCapabilities is the set of optional features that this build of
+// lancp supports.
+const SupportedCapabilities = CapabilityCompression | CapabilityMultiStream
+
+// Has returns true if every feature in other is in c.
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+// nonceLen is the length of session IDs and nonces, in bytes.
+const nonceLen = 16
+
+// message is the payload of a UDP message sent during the lancp handshake.
+type message struct {
+	// sessionID is chosen at random by the sender at the beginning of each
+	// handshake, and every message in that handshake carries it.
+	sessionID [nonceLen]byte
+
+	// nonce is chosen at random for each message, and echo is the nonce of the
+	// message that this one responds to. echo is all zeros in the message that
+	// begins a handshake. Together with sessionID, they tie every message to
+	// the one before it, so that messages from other handshakes, like ones
+	// that were captured and sent again later, can be told apart and dropped.
+	nonce [nonceLen]byte
+	echo  [nonceLen]byte
+
+	// capabilities is the set of optional features that the sender of the
+	// message supports, and wants to use in this session.
+	capabilities Capabilities
+
+	// share is the sender of the message's key exchange share. Empty if the
+	// message only carries a confirmation.
+	share []byte
+
+	// identity is the public key of the paired device that the sender of the
+	// message claims to be. Empty if the message is part of a handshake that's
+	// authenticated with a passphrase instead.
+	identity []byte
+
+	// confirmation is the sender of the message's proof that it derived the
+	// same keys as the other machine. Empty if it hasn't derived them yet.
+	confirmation []byte
+}
+
+// newSession returns a message that begins a new handshake, with a new random
+// session ID and nonce.
+func newSession() (*message, error) {
+	m := new(message)
+	if _, err := rand.Read(m.sessionID[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(m.nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// reply returns a message that responds to m, with the same session ID, a new
+// random nonce, and m's nonce echoed back.
+func (m *message) reply() (*message, error) {
+	r := &message{sessionID: m.sessionID, echo: m.nonce}
+	if _, err := rand.Read(r.nonce[:]); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// answers returns true if m is a response to prev, meaning that it's part of
+// the same session, and echoes prev's nonce.
+func (m *message) answers(prev *message) bool {
+	return m.sessionID == prev.sessionID && m.echo == prev.nonce
+}
+
+// encodeMessage encodes the provided handshake message.
+//
+// A handshake message is encoded as the same preamble that begins a lancp TLS
+// session, followed by the session ID, the nonce, and the echoed nonce, then
+// the sender's capabilities, then the length of the share and the share
+// itself, then the length of the identity and the identity itself, then the
+// confirmation.
+func encodeMessage(m *message) []byte {
+	buf := new(bytes.Buffer)
+	net.WritePreamble(buf)
+	buf.Write(m.sessionID[:])
+	buf.Write(m.nonce[:])
+	buf.Write(m.echo[:])
+	uvarintBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(uvarintBuf, uint64(m.capabilities))
+	buf.Write(uvarintBuf[:n])
+	for _, field := range [][]byte{m.share, m.identity} {
+		n = binary.PutUvarint(uvarintBuf, uint64(len(field)))
+		buf.Write(uvarintBuf[:n])
+		buf.Write(field)
+	}
+	buf.Write(m.confirmation)
+
+	return buf.Bytes()
+}
+
+// decodeMessage decodes the payload of a UDP message sent during the lancp
+// handshake. See encodeMessage for how handshake messages are encoded.
+//
+// If the message was sent by a build of lancp that speaks a different protocol
+// version, the returned error is a *net.VersionMismatchError.
+func decodeMessage(payload []byte) (*message, error) {
+	r := bytes.NewReader(payload)
+	if err := net.ReadPreamble(r); err != nil {
+		return nil, err
+	}
+	m := new(message)
+	for _, field := range [][]byte{m.sessionID[:], m.nonce[:], m.echo[:]} {
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, fmt.Errorf("failed to read session ID and nonces: %v",
+				err)
+		}
+	}
+	capabilities, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capabilities: %v", err)
+	}
+	m.capabilities = Capabilities(capabilities)
+	if m.share, err = readField(r, "share"); err != nil {
+		return nil, err
+	}
+	if m.identity, err = readField(r, "identity"); err != nil {
+		return nil, err
+	}
+	m.confirmation = make([]byte, r.Len())
+	r.Read(m.confirmation)
+
+	return m, nil
+}
+
+// readField reads a field that's preceded by its length from the provided
+// reader. name is what the field is called in errors.
+func readField(r *bytes.Reader, name string) ([]byte, error) {
+	fieldLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s length: %v", name, err)
+	}
+	if fieldLen > uint64(r.Len()) {
+		return nil, fmt.Errorf("got %d byte %s, but only %d bytes are left",
+			fieldLen, name, r.Len())
+	}
+	field := make([]byte, fieldLen)
+	r.Read(field)
+
+	return field, nil
+}
+
+// encodeContext encodes the capabilities that the sender asked for and the
+// ones that both machines agreed to, so that they can be mixed into the
+// session's keys. That way, nobody can tamper with them without being noticed.
+func encodeContext(requested, agreed Capabilities) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(requested))
+	n += binary.PutUvarint(buf[n:], uint64(agreed))
+
+	return buf[:n]
+}
+
+// sessionContext encodes everything about a handshake that both machines need
+// to agree on, so that it can be mixed into the session's keys: the session ID,
+// the nonces of the message that began the handshake and the response to it,
+// and the capabilities that each of them carried. A response that was meant
+// for another handshake, or spliced together from pieces of several, can't be
+// confirmed.
+func sessionContext(first, response *message) []byte {
+	context := append([]byte{}, first.sessionID[:]...)
+	context = append(context, first.nonce[:]...)
+	context = append(context, response.nonce[:]...)
+
+	return append(context, encodeContext(first.capabilities,
+		response.capabilities)...)
+}
+
+// describeVersionMismatch returns a more helpful error than the provided one,
+// which tells the user which machine needs to upgrade lancp.
+//
+// peerName is what the user should call the peer, like "sender".
+func describeVersionMismatch(
+	mismatchErr *net.VersionMismatchError,
+	peerName string,
+) error {
+	olderMachine := "this machine"
+	if mismatchErr.PeerVersion < net.ProtocolVersion {
+		olderMachine = "the " + peerName + "'s machine"
+	}
+	return fmt.Errorf("%s runs lancp protocol v%d, but this machine runs"+
+		" v%d; upgrade lancp on %s", peerName, mismatchErr.PeerVersion,
+		net.ProtocolVersion, olderMachine)
+}
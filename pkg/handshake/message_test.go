@@ -0,0 +1,137 @@
+package handshake
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		share        []byte
+		identity     []byte
+		confirmation []byte
+	}{
+		{nil, nil, nil},
+		{[]byte("share"), nil, nil},
+		{nil, nil, []byte("confirmation")},
+		{[]byte("share"), nil, []byte("confirmation")},
+		{[]byte("share"), []byte("identity"), nil},
+		{nil, []byte("identity"), []byte("confirmation")},
+	} {
+		first, err := newSession()
+		if err != nil {
+			t.Fatalf("unexpected error beginning session: %v", err)
+		}
+		want, err := first.reply()
+		if err != nil {
+			t.Fatalf("unexpected error replying to message: %v", err)
+		}
+		want.capabilities = SupportedCapabilities
+		want.share = tc.share
+		want.identity = tc.identity
+		want.confirmation = tc.confirmation
+
+		msg, err := decodeMessage(encodeMessage(want))
+		if err != nil {
+			t.Fatalf("unexpected error decoding message: %v", err)
+		}
+		if msg.sessionID != want.sessionID || msg.nonce != want.nonce ||
+			msg.echo != want.echo {
+			t.Fatalf("unexpected session ID or nonces, got: %x %x %x\n"+
+				"want: %x %x %x", msg.sessionID, msg.nonce, msg.echo,
+				want.sessionID, want.nonce, want.echo)
+		}
+		if !bytes.Equal(msg.share, tc.share) {
+			t.Fatalf("unexpected share, got: %q\nwant: %q", msg.share,
+				tc.share)
+		}
+		if !bytes.Equal(msg.identity, tc.identity) {
+			t.Fatalf("unexpected identity, got: %q\nwant: %q", msg.identity,
+				tc.identity)
+		}
+		if !bytes.Equal(msg.confirmation, tc.confirmation) {
+			t.Fatalf("unexpected confirmation, got: %q\nwant: %q",
+				msg.confirmation, tc.confirmation)
+		}
+		if msg.capabilities != SupportedCapabilities {
+			t.Fatalf("unexpected capabilities, got: %b\nwant: %b",
+				msg.capabilities, SupportedCapabilities)
+		}
+	}
+}
+
+func TestDecodeTruncatedMessage(t *testing.T) {
+	payload := encodeMessage(&message{
+		capabilities: SupportedCapabilities,
+		share:        []byte("share"),
+	})
+
+	if _, err := decodeMessage(payload[:len(payload)-1]); err == nil {
+		t.Fatal("expected an error decoding a truncated message")
+	}
+}
+
+func TestDecodeMessageFromOtherVersion(t *testing.T) {
+	payload := encodeMessage(&message{
+		capabilities: SupportedCapabilities,
+		share:        []byte("share"),
+	})
+	payload[len("LANCP")]++
+
+	_, err := decodeMessage(payload)
+	var mismatchErr *net.VersionMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("unexpected error, got: %v\nwant: *net.VersionMismatchError",
+			err)
+	}
+	if mismatchErr.PeerVersion != net.ProtocolVersion+1 {
+		t.Fatalf("unexpected peer version, got: %d\nwant: %d",
+			mismatchErr.PeerVersion, net.ProtocolVersion+1)
+	}
+}
+
+func TestMessageAnswers(t *testing.T) {
+	first, err := newSession()
+	if err != nil {
+		t.Fatalf("unexpected error beginning session: %v", err)
+	}
+	response, err := first.reply()
+	if err != nil {
+		t.Fatalf("unexpected error replying to message: %v", err)
+	}
+	confirmation, err := response.reply()
+	if err != nil {
+		t.Fatalf("unexpected error replying to message: %v", err)
+	}
+	other, err := newSession()
+	if err != nil {
+		t.Fatalf("unexpected error beginning session: %v", err)
+	}
+	otherResponse, err := other.reply()
+	if err != nil {
+		t.Fatalf("unexpected error replying to message: %v", err)
+	}
+	spliced := *response
+	spliced.sessionID = other.sessionID
+
+	for name, tc := range map[string]struct {
+		msg, prev *message
+		want      bool
+	}{
+		"response":                  {response, first, true},
+		"confirmation":              {confirmation, response, true},
+		"response to itself":        {first, first, false},
+		"confirmation to first":     {confirmation, first, false},
+		"other session":             {otherResponse, first, false},
+		"other session ID":          {&spliced, first, false},
+		"response to other session": {response, other, false},
+	} {
+		if got := tc.msg.answers(tc.prev); got != tc.want {
+			t.Fatalf("%s: unexpected answer, got: %t\nwant: %t", name, got,
+				tc.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package handshake
+
+import (
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/device"
+)
+
+// pairedTimeout is how long a sender waits for a receiver that it's paired
+// with to respond before it asks for the passphrase instead. Receivers that
+// aren't paired with it never respond, so it shouldn't wait long.
+const pairedTimeout = 2 * time.Second
+
+// errNoPairedReceiver is returned when no receiver that the sender is paired
+// with responds to it.
+var errNoPairedReceiver = errors.New("no paired receiver responded")
+
+// pairedExchange carries out one machine's side of a key exchange between two
+// paired devices, which doesn't need a passphrase. Both machines send each
+// other an ephemeral Diffie-Hellman share along with their identity, and then
+// sign both shares and both identities to confirm the keys. Only the devices
+// that the identities belong to can sign for them, and nobody else can derive
+// the keys from the shares.
+type pairedExchange struct {
+	role role
+
+	// identity is this machine's identity.
+	identity *device.Identity
+
+	// secret is this machine's ephemeral private scalar.
+	secret []byte
+
+	// share is what this machine sends to the other one.
+	share []byte
+}
+
+// newPairedExchange returns a pointer to a new pairedExchange struct for the
+// provided side of the handshake, with a new random share.
+func newPairedExchange(
+	r role,
+	identity *device.Identity,
+) (*pairedExchange, error) {
+	secret, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pairedExchange{r, identity, secret, elliptic.Marshal(curve, x, y)},
+		nil
+}
+
+// finish derives the session's keys from the other machine's share and
+// identity, and signs our confirmation. context is signed too, so that both
+// machines only confirm each other if they agree on it.
+func (p *pairedExchange) finish(
+	peerShare []byte,
+	peerIdentity ed25519.PublicKey,
+	context []byte,
+) (*sessionKeys, error) {
+	px, py := elliptic.Unmarshal(curve, peerShare)
+	if px == nil {
+		return nil, errors.New("share isn't a point on the curve")
+	}
+	if len(peerIdentity) != ed25519.PublicKeySize {
+		return nil, errors.New("identity isn't a public key")
+	}
+	kx, ky := curve.ScalarMult(px, py, p.secret)
+
+	senderShare, receiverShare := p.share, peerShare
+	senderKey, receiverKey := p.identity.PublicKey, peerIdentity
+	if p.role == roleReceiver {
+		senderShare, receiverShare = peerShare, p.share
+		senderKey, receiverKey = peerIdentity, p.identity.PublicKey
+	}
+	signed := encodeTranscript(
+		senderIdentity,
+		receiverIdentity,
+		senderKey,
+		receiverKey,
+		senderShare,
+		receiverShare,
+		context,
+	)
+	digest := sha512.Sum512(encodeTranscript(signed,
+		elliptic.Marshal(curve, kx, ky)))
+
+	keys := &sessionKeys{
+		key:          digest[:32],
+		peerIdentity: peerIdentity,
+		signed:       signed,
+	}
+	confirmation := p.identity.Sign(signedMessage(p.role, signed))
+	if p.role == roleReceiver {
+		keys.receiverConfirmation = confirmation
+	} else {
+		keys.senderConfirmation = confirmation
+	}
+
+	return keys, nil
+}
+
+// signedMessage returns what the machine on the provided side of a paired
+// exchange signs to confirm the keys, given what both machines sign.
+func signedMessage(r role, signed []byte) []byte {
+	label := senderIdentity
+	if r == roleReceiver {
+		label = receiverIdentity
+	}
+
+	return append(append([]byte{}, label...), signed...)
+}
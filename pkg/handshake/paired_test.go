@@ -0,0 +1,132 @@
+package handshake
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nchaloult/lancp/pkg/device"
+)
+
+// loadIdentities returns two new identities, stored in a temp dir that's
+// removed by the returned func.
+func loadIdentities(t *testing.T) (*device.Identity, *device.Identity, func()) {
+	dir, err := ioutil.TempDir("", "lancp")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	sender, err := device.LoadIdentity(filepath.Join(dir, "sender"))
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+	receiver, err := device.LoadIdentity(filepath.Join(dir, "receiver"))
+	if err != nil {
+		t.Fatalf("unexpected error creating identity: %v", err)
+	}
+
+	return sender, receiver, func() { os.RemoveAll(dir) }
+}
+
+func TestPairedExchange(t *testing.T) {
+	senderIdentity, receiverIdentity, cleanUp := loadIdentities(t)
+	defer cleanUp()
+	context := encodeContext(SupportedCapabilities, CapabilityCompression)
+
+	sender, err := newPairedExchange(roleSender, senderIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error beginning sender's exchange: %v", err)
+	}
+	receiver, err := newPairedExchange(roleReceiver, receiverIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error beginning receiver's exchange: %v", err)
+	}
+	receiverKeys, err := receiver.finish(sender.share,
+		senderIdentity.PublicKey, context)
+	if err != nil {
+		t.Fatalf("unexpected error finishing receiver's exchange: %v", err)
+	}
+	senderKeys, err := sender.finish(receiver.share,
+		receiverIdentity.PublicKey, context)
+	if err != nil {
+		t.Fatalf("unexpected error finishing sender's exchange: %v", err)
+	}
+
+	if !bytes.Equal(senderKeys.key, receiverKeys.key) {
+		t.Fatal("expected both machines to derive the same key")
+	}
+	if !senderKeys.confirms(roleReceiver, receiverKeys.receiverConfirmation) {
+		t.Fatal("expected the sender to accept the receiver's confirmation")
+	}
+	if !receiverKeys.confirms(roleSender, senderKeys.senderConfirmation) {
+		t.Fatal("expected the receiver to accept the sender's confirmation")
+	}
+	// Neither machine's confirmation can be sent back to it.
+	if senderKeys.confirms(roleReceiver, senderKeys.senderConfirmation) {
+		t.Fatal("expected the sender to reject its own confirmation")
+	}
+}
+
+func TestPairedExchangeRejectsImpostor(t *testing.T) {
+	senderIdentity, receiverIdentity, cleanUp := loadIdentities(t)
+	defer cleanUp()
+	impostorIdentity, _, cleanUpImpostor := loadIdentities(t)
+	defer cleanUpImpostor()
+
+	// The impostor claims to be the receiver, but can only sign with its own
+	// identity.
+	sender, err := newPairedExchange(roleSender, senderIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error beginning sender's exchange: %v", err)
+	}
+	impostor, err := newPairedExchange(roleReceiver, impostorIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error beginning impostor's exchange: %v", err)
+	}
+	impostorKeys, err := impostor.finish(sender.share,
+		senderIdentity.PublicKey, nil)
+	if err != nil {
+		t.Fatalf("unexpected error finishing impostor's exchange: %v", err)
+	}
+	senderKeys, err := sender.finish(impostor.share,
+		receiverIdentity.PublicKey, nil)
+	if err != nil {
+		t.Fatalf("unexpected error finishing sender's exchange: %v", err)
+	}
+
+	if senderKeys.confirms(roleReceiver, impostorKeys.receiverConfirmation) {
+		t.Fatal("expected the sender to reject the impostor's confirmation")
+	}
+}
+
+func TestPairedExchangeDifferentContext(t *testing.T) {
+	senderIdentity, receiverIdentity, cleanUp := loadIdentities(t)
+	defer cleanUp()
+
+	sender, err := newPairedExchange(roleSender, senderIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error beginning sender's exchange: %v", err)
+	}
+	receiver, err := newPairedExchange(roleReceiver, receiverIdentity)
+	if err != nil {
+		t.Fatalf("unexpected error beginning receiver's exchange: %v", err)
+	}
+	receiverKeys, err := receiver.finish(sender.share,
+		senderIdentity.PublicKey,
+		encodeContext(SupportedCapabilities, CapabilityCompression))
+	if err != nil {
+		t.Fatalf("unexpected error finishing receiver's exchange: %v", err)
+	}
+	senderKeys, err := sender.finish(receiver.share,
+		receiverIdentity.PublicKey,
+		encodeContext(SupportedCapabilities, SupportedCapabilities))
+	if err != nil {
+		t.Fatalf("unexpected error finishing sender's exchange: %v", err)
+	}
+
+	if senderKeys.confirms(roleReceiver, receiverKeys.receiverConfirmation) {
+		t.Fatal("expected machines with different contexts not to confirm" +
+			" each other")
+	}
+}
@@ -1,11 +1,14 @@
 package handshake
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"math"
+	_net "net"
+	"time"
 
-	"github.com/nchaloult/lancp/pkg/input"
+	"github.com/nchaloult/lancp/pkg/device"
 	"github.com/nchaloult/lancp/pkg/net"
 	"github.com/nchaloult/lancp/pkg/passphrase"
 )
@@ -14,16 +17,54 @@ import (
 // receiver in the lancp handshake process. It stores configurations for the
 // handshake.
 type ReceiverConductor struct {
-	// capturer is the object responsible for prompting the user for
-	// command-line input, and reading that input.
-	capturer *input.Capturer
-
-	// port is the UDP port that the handshake takes place on.
-	port string
+	// port is the UDP port that the handshake takes place on, and tcpPort is
+	// the TCP port that everything after it does. tcpPort is the one that's
+	// advertised over multicast DNS, since the service is a TCP service.
+	port    string
+	tcpPort string
 
 	// timeoutDuration is the number of seconds that the sender should wait for
 	// responses from the sender before failing fast.
 	timeoutDuration uint
+
+	// capabilities is the set of optional features that the receiver is
+	// willing to use in this session, if the sender wants to use them too.
+	capabilities Capabilities
+
+	// numWords is the number of words in the passphrase, and withNumber is
+	// true if a number is tacked on to the end of it.
+	numWords   int
+	withNumber bool
+
+	// maxAttempts is the number of attempts to begin the handshake that the
+	// receiver answers before it gives up.
+	maxAttempts int
+
+	// identity is this machine's identity, and knownDevices are the devices
+	// that it's paired with. If identity is nil, the handshake is always
+	// authenticated with a passphrase.
+	identity     *device.Identity
+	knownDevices *device.KnownDevices
+
+	// pairedDevice is the paired device that the handshake authenticated, or
+	// nil if it was authenticated with the passphrase.
+	pairedDevice *device.Device
+}
+
+// attempt is an attempt to begin the handshake that the receiver answered, and
+// is waiting for the sender to confirm.
+type attempt struct {
+	// response is what we sent back to the sender. Its confirmation has to
+	// answer it.
+	response *message
+	keys     *sessionKeys
+
+	// pairedDevice is the paired device that the sender claims to be, or nil
+	// if it's using the passphrase.
+	pairedDevice *device.Device
+
+	// expires is when to stop waiting for the sender to confirm.
+	expires time.Time
 }
 
 // NewReceiverConductor returns a pointer to a new ReceiverConductor struct
@@ -31,56 +72,260 @@ type ReceiverConductor struct {
 //
 // timeoutDuration is in seconds.
 //
-// port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
+// port and tcpPort need to look like port strings (i.e., ":xxxx" or
+// ":xxxxx").
+//
+// capabilities must be a subset of SupportedCapabilities.
+//
+// numWords must be between 1 and passphrase.MaxNumWords.
+//
+// maxAttempts must be at least 1.
+//
+// identity and knownDevices may be nil, in which case the handshake is always
+// authenticated with a passphrase.
 func NewReceiverConductor(
-	port string,
+	port, tcpPort string,
 	timeoutDuration uint,
+	capabilities Capabilities,
+	numWords int,
+	withNumber bool,
+	maxAttempts int,
+	identity *device.Identity,
+	knownDevices *device.KnownDevices,
 ) (*ReceiverConductor, error) {
-	capturer, err := input.NewCapturer("➜", "sender", os.Stdin, os.Stdout)
-	if err != nil {
-		return nil, err
+	if !SupportedCapabilities.Has(capabilities) {
+		return nil, fmt.Errorf("unsupported capabilities: %b", capabilities)
+	}
+	if numWords < 1 || numWords > passphrase.MaxNumWords {
+		return nil, fmt.Errorf("got %d passphrase words, want between 1 and"+
+			" %d", numWords, passphrase.MaxNumWords)
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("got %d attempts, want at least 1", maxAttempts)
 	}
 
-	return &ReceiverConductor{capturer, port, timeoutDuration}, nil
+	return &ReceiverConductor{
+		port,
+		tcpPort,
+		timeoutDuration,
+		capabilities,
+		numWords,
+		withNumber,
+		maxAttempts,
+		identity,
+		knownDevices,
+		nil,
+	}, nil
 }
 
 // ConductHandshake executes the steps involved in the lancp handshake process.
-// It listens for a UDP broadcast message from a potential sender, checks that
-// sender's passphrase guess, reads in a passphrase guess from the user, and
-// responds to the sender with that guess.
-func (c *ReceiverConductor) ConductHandshake() error {
-	// Display the expected passphrase for the receiver to send.
-	expectedPassphrase := passphrase.Generate()
-	log.Printf("Passphrase: %s\n", expectedPassphrase)
-
-	// Receive broadcast message from sender, and check that the passphrase they
-	// sent matches what we expect.
-	conn, err := net.CreateUDPConn(c.port)
+// It displays a passphrase, listens for UDP broadcast messages from potential
+// senders, checks that each sender speaks the same protocol version as us, and
+// finishes the SPAKE2 exchange that it began with the passphrase. Then, it
+// waits for one of those senders to prove that it started with the same
+// passphrase.
+//
+// Senders that started with the wrong passphrase are ignored, and since our
+// response is the same either way, they can't tell that they were wrong until
+// they fail to confirm it. Only maxAttempts attempts are answered, and attempts
+// that come in too quickly from the same address are ignored, so that nobody
+// can guess their way through the passphrase. It gives up once the budget is
+// used up, or if nobody confirms the passphrase within the timeout duration.
+//
+// Senders that this machine is paired with don't need the passphrase. They're
+// answered with our identity and a signed confirmation instead, and aren't
+// counted against the budget.
+//
+// Returns the sender's address, along with the optional features that both
+// machines agreed to use, and the secret key that authenticates the rest of the
+// session.
+func (c *ReceiverConductor) ConductHandshake() (
+	_net.Addr,
+	Capabilities,
+	[]byte,
+	error,
+) {
+	// Display the passphrase that the sender needs to know.
+	expectedPassphrase, err := passphrase.Generate(c.numWords, c.withNumber)
 	if err != nil {
-		return fmt.Errorf("failed to create a UDP connection for handshake: %v",
-			err)
+		return nil, 0, nil, fmt.Errorf("failed to generate passphrase: %v", err)
 	}
-	defer conn.Close()
-	msg, err := net.ReceiveUDPMessage(conn, c.timeoutDuration, c.port)
+	log.Printf("Passphrase: %s (%.0f bits of entropy)\n",
+		expectedPassphrase, passphrase.Entropy(c.numWords, c.withNumber))
+
+	conn, err := net.CreateUDPConn(c.port)
 	if err != nil {
-		return fmt.Errorf("failed to receive broadcast message from sender: %v",
-			err)
-	}
-	if msg.Payload != expectedPassphrase {
-		return fmt.Errorf("got passphrase %q from sender, want %q",
-			msg.Payload, expectedPassphrase)
+		return nil, 0, nil, fmt.Errorf("failed to create a UDP connection for"+
+			" handshake: %v", err)
 	}
+	defer conn.Close()
 
-	// Ask the user to type in the passphrase that's displayed on the sender's
-	// machine.
-	input, err := c.capturer.CapturePassphrase()
+	// Senders on networks that filter broadcasts look for us over multicast
+	// DNS instead. If we can't advertise ourselves, they can still find us
+	// with broadcasts.
+	responder, err := c.advertise()
 	if err != nil {
-		return fmt.Errorf("failed to capture passphrase input from user: %v",
-			err)
+		log.Printf("Couldn't advertise over mDNS: %v\n", err)
+	} else {
+		defer responder.Close()
 	}
 
-	// Send response with our passphrase guess to the sender.
-	net.SendUDPMessage([]byte(input), conn, msg.ReturnAddr)
+	deadline := time.Now().Add(time.Duration(c.timeoutDuration) * time.Second)
+	limiter := newAttemptLimiter(c.maxAttempts, attemptInterval)
+	// Maps each sender's address to the attempt that we're waiting for it to
+	// confirm.
+	pending := make(map[string]*attempt)
+	// The session IDs of every attempt that we've answered.
+	answered := make(map[[nonceLen]byte]bool)
+	for {
+		// Stop waiting for confirmations that aren't coming, and figure out
+		// how long to wait for the next message.
+		wakeUp := deadline
+		for sender, a := range pending {
+			if time.Now().After(a.expires) {
+				delete(pending, sender)
+			} else if a.expires.Before(wakeUp) {
+				wakeUp = a.expires
+			}
+		}
+		if limiter.exhausted() && len(pending) == 0 {
+			return nil, 0, nil, fmt.Errorf("gave up after %d attempts with"+
+				" the wrong passphrase", c.maxAttempts)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, 0, nil, fmt.Errorf("nobody typed in the passphrase"+
+				" within %d seconds", c.timeoutDuration)
+		}
+
+		msg, err := net.ReceiveUDPMessage(conn,
+			uint(math.Ceil(time.Until(wakeUp).Seconds())), c.port)
+		if errors.Is(err, net.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to receive handshake"+
+				" message from sender: %v", err)
+		}
+		senderMsg, err := decodeMessage([]byte(msg.Payload))
+		var mismatchErr *net.VersionMismatchError
+		if errors.As(err, &mismatchErr) {
+			log.Printf("Ignored a sender at %s: %v\n", msg.ReturnAddr,
+				describeVersionMismatch(mismatchErr, "sender"))
+			// Let the sender know that we speak a different protocol version,
+			// so they can fail fast too. Anyone can claim to speak another
+			// version, so these replies count against the same limit as
+			// attempts that we answer.
+			if limiter.allow(msg.ReturnAddr, time.Now()) {
+				net.SendUDPMessage(encodeMessage(&message{}), conn,
+					msg.ReturnAddr)
+			}
+			continue
+		}
+		if err != nil {
+			// Whatever it is, it isn't meant for us.
+			continue
+		}
+
+		sender := msg.ReturnAddr.String()
+		if len(senderMsg.share) == 0 {
+			a, ok := pending[sender]
+			if !ok || !senderMsg.answers(a.response) {
+				// It's either stale, or somebody pretending to be the
+				// sender, so it shouldn't cancel the real sender's attempt.
+				continue
+			}
+			delete(pending, sender)
+			if a.keys.confirms(roleSender, senderMsg.confirmation) {
+				if a.pairedDevice != nil {
+					log.Printf("Authenticated %s as a paired device\n",
+						a.pairedDevice.Name)
+				}
+				c.pairedDevice = a.pairedDevice
+				return msg.ReturnAddr, a.response.capabilities, a.keys.key,
+					nil
+			}
+			if a.pairedDevice != nil {
+				log.Printf("Ignored a sender at %s that couldn't prove that"+
+					" it's %s\n", sender, a.pairedDevice.Name)
+			} else {
+				log.Printf("Ignored a sender at %s who typed in the wrong"+
+					" passphrase\n", sender)
+			}
+			continue
+		}
+		// Each session is only answered once, so that a message that begins
+		// one can't be sent again to use up attempts.
+		if answered[senderMsg.sessionID] {
+			continue
+		}
+		response, err := senderMsg.reply()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to respond to sender: %v",
+				err)
+		}
+		response.capabilities = c.capabilities & senderMsg.capabilities
+
+		var keys *sessionKeys
+		var pairedDevice *device.Device
+		if len(senderMsg.identity) != 0 {
+			// Senders that we aren't paired with are ignored. They'll ask for
+			// the passphrase once they've waited long enough.
+			if c.identity == nil {
+				continue
+			}
+			var ok bool
+			pairedDevice, ok = c.knownDevices.Lookup(senderMsg.identity)
+			if !ok {
+				continue
+			}
+			exchange, err := newPairedExchange(roleReceiver, c.identity)
+			if err != nil {
+				return nil, 0, nil, fmt.Errorf("failed to begin key"+
+					" exchange: %v", err)
+			}
+			keys, err = exchange.finish(senderMsg.share,
+				pairedDevice.PublicKey, sessionContext(senderMsg, response))
+			if err != nil {
+				continue
+			}
+			response.share = exchange.share
+			response.identity = c.identity.PublicKey
+		} else {
+			if !limiter.allow(msg.ReturnAddr, time.Now()) {
+				continue
+			}
+
+			// We can't tell whether the sender started with the right
+			// passphrase until it proves so, too.
+			pake, err := newSPAKE2(roleReceiver, expectedPassphrase)
+			if err != nil {
+				return nil, 0, nil, fmt.Errorf("failed to begin key"+
+					" exchange: %v", err)
+			}
+			keys, err = pake.finish(senderMsg.share,
+				sessionContext(senderMsg, response))
+			if err != nil {
+				continue
+			}
+			response.share = pake.share
+		}
+
+		// Respond with our share, the optional features that we'll use in
+		// this session, and proof that we derived the keys that go with them.
+		response.confirmation = keys.receiverConfirmation
+		net.SendUDPMessage(encodeMessage(response), conn, msg.ReturnAddr)
+		answered[senderMsg.sessionID] = true
+		pending[sender] = &attempt{
+			response,
+			keys,
+			pairedDevice,
+			time.Now().Add(confirmationTimeout),
+		}
+	}
+}
 
-	return nil
+// PairedDevice returns the paired device that the handshake authenticated, or
+// nil if it was authenticated with the passphrase instead.
+func (c *ReceiverConductor) PairedDevice() *device.Device {
+	return c.pairedDevice
 }
@@ -1,11 +1,16 @@
 package handshake
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	_net "net"
 	"os"
+	"time"
 
+	"github.com/nchaloult/lancp/pkg/device"
 	"github.com/nchaloult/lancp/pkg/input"
 	"github.com/nchaloult/lancp/pkg/net"
 	"github.com/nchaloult/lancp/pkg/passphrase"
@@ -21,9 +26,35 @@ type SenderConductor struct {
 	// port is the UDP port that the handshake takes place on.
 	port string
 
+	// ifaceName is the name of the network interface to broadcast on, or
+	// empty to broadcast on every one.
+	ifaceName string
+
+	// discovery is how receivers are found.
+	discovery Discovery
+
+	// host is the host name or IP address of the receiver, if the user knows
+	// it, in which case the handshake is sent straight to it, and discovery
+	// isn't used.
+	host string
+
 	// timeoutDuration is the number of seconds that the sender should wait for
 	// responses from potential receivers before failing fast.
 	timeoutDuration uint
+
+	// capabilities is the set of optional features that the sender wants to
+	// use in this session, if the receiver supports them too.
+	capabilities Capabilities
+
+	// identity is this machine's identity, and knownDevices are the devices
+	// that it's paired with. If identity is nil, the handshake is always
+	// authenticated with a passphrase.
+	identity     *device.Identity
+	knownDevices *device.KnownDevices
+
+	// pairedDevice is the paired device that the handshake authenticated, or
+	// nil if it was authenticated with a passphrase.
+	pairedDevice *device.Device
 }
 
 // NewSenderConductor returns a pointer to a new SenderConductor struct
@@ -32,62 +63,252 @@ type SenderConductor struct {
 // timeoutDuration is in seconds.
 //
 // port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
+//
+// ifaceName is the name of the only network interface to broadcast on. If it's
+// empty, the handshake is broadcast on every network interface that's up.
+//
+// discovery is how receivers are found, either by broadcasting or by looking
+// for them over multicast DNS.
+//
+// host is the receiver's host name or IP address. If it isn't empty, the
+// handshake is sent straight to that host, instead of to every receiver that
+// discovery finds.
+//
+// inputReader is where the user's passphrase guess is read from. Should be
+// os.Stdin, unless stdin is being used for something else.
+//
+// capabilities must be a subset of SupportedCapabilities.
+//
+// identity and knownDevices may be nil, in which case the handshake is always
+// authenticated with a passphrase.
 func NewSenderConductor(
-	port string,
+	port, ifaceName string,
+	discovery Discovery,
+	host string,
 	timeoutDuration uint,
+	inputReader io.Reader,
+	capabilities Capabilities,
+	identity *device.Identity,
+	knownDevices *device.KnownDevices,
 ) (*SenderConductor, error) {
-	capturer, err := input.NewCapturer("➜", "receiver", os.Stdin, os.Stdout)
+	if !SupportedCapabilities.Has(capabilities) {
+		return nil, fmt.Errorf("unsupported capabilities: %b", capabilities)
+	}
+	capturer, err := input.NewCapturer("➜", "receiver", inputReader, os.Stderr)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SenderConductor{capturer, port, timeoutDuration}, nil
+	return &SenderConductor{
+		capturer,
+		port,
+		ifaceName,
+		discovery,
+		host,
+		timeoutDuration,
+		capabilities,
+		identity,
+		knownDevices,
+		nil,
+	}, nil
 }
 
 // ConductHandshake executes the steps involved in the lancp handshake process.
-// It reads in a passphrase guess from the user, sends it in a UDP broadcast
-// message, waits for a receiver to respond, and checks that receiver's
-// passphrase guess.
+// If this machine is paired with any devices, it first gives receivers that
+// it's paired with a chance to respond without a passphrase (see
+// conductPairedHandshake). Otherwise, it reads in the passphrase that's
+// displayed on the receiver's machine from the user, begins a SPAKE2 exchange
+// with it in a UDP broadcast message, waits for a receiver to respond, checks
+// that the receiver speaks the same protocol version as us, and checks that
+// the receiver started with the same passphrase. Then, it proves to the
+// receiver that we did too.
 //
 // Returns the receiver's address so that we can attempt to establish a TCP
-// connection with that address later.
-func (c *SenderConductor) ConductHandshake() (_net.Addr, error) {
+// connection with that address later, along with the optional features that
+// both machines agreed to use, and the secret key that authenticates the rest
+// of the session.
+func (c *SenderConductor) ConductHandshake() (
+	_net.Addr,
+	Capabilities,
+	[]byte,
+	error,
+) {
+	discoveryAddrs, err := c.findReceivers()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	conn, err := net.CreateUDPConn(c.port)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to create a UDP connection for"+
+			" handshake: %v", err)
+	}
+	defer conn.Close()
+
+	if c.identity != nil && c.knownDevices.Len() > 0 {
+		addr, capabilities, key, err := c.conductPairedHandshake(conn,
+			discoveryAddrs)
+		if !errors.Is(err, errNoPairedReceiver) {
+			return addr, capabilities, key, err
+		}
+	}
+
 	// Ask the user to type in the passphrase that's displayed on the receiver's
 	// machine.
 	input, err := c.capturer.CapturePassphrase()
 	if err != nil {
-		return nil, fmt.Errorf("failed to capture passphrase input from user:"+
-			" %v", err)
+		return nil, 0, nil, fmt.Errorf("failed to capture passphrase input"+
+			" from user: %v", err)
+	}
+	pake, err := newSPAKE2(roleSender, passphrase.Normalize(input))
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to begin key exchange: %v",
+			err)
 	}
 
-	// Send UDP broadcast message to a receiver who's potentially listening.
-	broadcastAddr, err := net.GetUDPBroadcastAddr(c.port)
+	// Send UDP broadcast messages to a receiver who's potentially listening.
+	first, err := newSession()
 	if err != nil {
-		return nil, fmt.Errorf("failed to build UDP broadcast address: %v", err)
+		return nil, 0, nil, fmt.Errorf("failed to begin handshake: %v", err)
 	}
-	conn, err := net.CreateUDPConn(c.port)
+	first.capabilities = c.capabilities
+	first.share = pake.share
+	net.SendUDPMessageToAll(encodeMessage(first), conn, discoveryAddrs)
+
+	// Receive response from receiver, and check that it derived the same keys
+	// as us.
+	response, receiverAddr, err := c.awaitResponse(conn, first,
+		time.Duration(c.timeoutDuration)*time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create a UDP connection for"+
-			" handshake: %v", err)
+		return nil, 0, nil, fmt.Errorf("failed to receive handshake response"+
+			" from receiver: %v", err)
 	}
-	defer conn.Close()
-	net.SendUDPMessage([]byte(input), conn, broadcastAddr)
+	keys, err := pake.finish(response.share, sessionContext(first, response))
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("got malformed handshake response from"+
+			" receiver: %v", err)
+	}
+	confirmation, err := response.reply()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to respond to receiver: %v",
+			err)
+	}
+	if !keys.confirms(roleReceiver, response.confirmation) {
+		// Let the receiver know that we're giving up, without a
+		// confirmation that could be used to guess the passphrase.
+		confirmation.capabilities = c.capabilities
+		net.SendUDPMessage(encodeMessage(confirmation), conn, receiverAddr)
+		return nil, 0, nil, errors.New("passphrase doesn't match the one" +
+			" displayed on the receiver's machine")
+	}
+
+	// Prove to the receiver that we derived the same keys, too.
+	confirmation.capabilities = c.capabilities & response.capabilities
+	confirmation.confirmation = keys.senderConfirmation
+	net.SendUDPMessage(encodeMessage(confirmation), conn, receiverAddr)
 
-	// Display the expected passphrase for the receiver to send.
-	expectedPassphrase := passphrase.Generate()
-	log.Printf("Passphrase: %s\n", expectedPassphrase)
+	return receiverAddr, confirmation.capabilities, keys.key, nil
+}
 
-	// Receive response from receiver, and check that the passphrase they sent
-	// matches what we expect.
-	msg, err := net.ReceiveUDPMessage(conn, c.timeoutDuration, c.port)
+// conductPairedHandshake begins a key exchange with our identity in a UDP
+// broadcast message, and waits a moment for a receiver that we're paired with
+// to respond with its identity and signed confirmation. Then, it proves to the
+// receiver who we are, too. Responses from receivers that we aren't paired
+// with, or that can't prove who they are, are ignored.
+//
+// Returns errNoPairedReceiver if no receiver that we're paired with responds
+// in time, so that the caller can fall back to a passphrase.
+func (c *SenderConductor) conductPairedHandshake(
+	conn _net.PacketConn,
+	discoveryAddrs []*_net.UDPAddr,
+) (_net.Addr, Capabilities, []byte, error) {
+	exchange, err := newPairedExchange(roleSender, c.identity)
 	if err != nil {
-		return nil, fmt.Errorf("failed to receive handshake response from"+
-			" receiver: %v", err)
+		return nil, 0, nil, fmt.Errorf("failed to begin key exchange: %v",
+			err)
+	}
+	first, err := newSession()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to begin handshake: %v", err)
+	}
+	first.capabilities = c.capabilities
+	first.share = exchange.share
+	first.identity = c.identity.PublicKey
+	net.SendUDPMessageToAll(encodeMessage(first), conn, discoveryAddrs)
+
+	deadline := time.Now().Add(pairedTimeout)
+	for {
+		response, receiverAddr, err := c.awaitResponse(conn, first,
+			time.Until(deadline))
+		if errors.Is(err, net.ErrTimeout) {
+			return nil, 0, nil, errNoPairedReceiver
+		}
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to receive handshake"+
+				" response from receiver: %v", err)
+		}
+		receiver, ok := c.knownDevices.Lookup(response.identity)
+		if !ok {
+			continue
+		}
+		keys, err := exchange.finish(response.share, receiver.PublicKey,
+			sessionContext(first, response))
+		if err != nil || !keys.confirms(roleReceiver, response.confirmation) {
+			log.Printf("Ignored a receiver at %s that couldn't prove that it's"+
+				" %s\n", receiverAddr, receiver.Name)
+			continue
+		}
+
+		confirmation, err := response.reply()
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to respond to receiver:"+
+				" %v", err)
+		}
+		confirmation.capabilities = c.capabilities & response.capabilities
+		confirmation.confirmation = keys.senderConfirmation
+		net.SendUDPMessage(encodeMessage(confirmation), conn, receiverAddr)
+		log.Printf("Authenticated %s as a paired device\n", receiver.Name)
+		c.pairedDevice = receiver
+		return receiverAddr, confirmation.capabilities, keys.key, nil
 	}
-	if msg.Payload != expectedPassphrase {
-		return nil, fmt.Errorf("got passphrase %q from receiver, want %q",
-			msg.Payload, expectedPassphrase)
+}
+
+// awaitResponse waits for a response to the provided message, which began a
+// handshake, and returns it along with the address that it came from. Messages
+// that aren't a response to it, like ones from another handshake, are dropped.
+// If nothing responds within the provided timeout, the returned error wraps
+// net.ErrTimeout.
+func (c *SenderConductor) awaitResponse(
+	conn _net.PacketConn,
+	first *message,
+	timeout time.Duration,
+) (*message, _net.Addr, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		msg, err := net.ReceiveUDPMessage(conn,
+			uint(math.Ceil(time.Until(deadline).Seconds())), c.port)
+		if errors.Is(err, net.ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err := decodeMessage([]byte(msg.Payload))
+		var mismatchErr *net.VersionMismatchError
+		if errors.As(err, &mismatchErr) {
+			return nil, nil, describeVersionMismatch(mismatchErr, "receiver")
+		}
+		if err != nil || !response.answers(first) {
+			continue
+		}
+		return response, msg.ReturnAddr, nil
 	}
 
-	return msg.ReturnAddr, nil
+	return nil, nil, fmt.Errorf("%w after %d seconds", net.ErrTimeout,
+		int(math.Round(timeout.Seconds())))
+}
+
+// PairedDevice returns the paired device that the handshake authenticated, or
+// nil if it was authenticated with a passphrase instead.
+func (c *SenderConductor) PairedDevice() *device.Device {
+	return c.pairedDevice
 }
@@ -0,0 +1,212 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// role is which side of the handshake a machine is on.
+type role int
+
+const (
+	roleSender role = iota
+	roleReceiver
+)
+
+// Identities that each machine uses in the SPAKE2 transcript.
+var (
+	senderIdentity   = []byte("lancp sender")
+	receiverIdentity = []byte("lancp receiver")
+)
+
+var curve = elliptic.P256()
+
+// The points M and N for P-256 from RFC 9382. Nobody knows their discrete
+// logarithms, which is what makes them safe to blind shares with.
+var (
+	pointMX, pointMY = mustDecompress("02886e2f97ace46e55ba9dd7242579f2993b" +
+		"64e16ef3dcab95afd497333d8fa12f")
+	pointNX, pointNY = mustDecompress("03d8bbd6c639c62937b04d997f38c3770719" +
+		"c629d7014d49a24b4f98baa1292b49")
+)
+
+func mustDecompress(s string) (*big.Int, *big.Int) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	x, y := elliptic.UnmarshalCompressed(curve, b)
+	if x == nil {
+		panic("point isn't on the curve: " + s)
+	}
+	return x, y
+}
+
+// spake2 carries out one machine's side of SPAKE2, a password-authenticated
+// key exchange, as described in RFC 9382. Both machines send each other a
+// share that's blinded with the passphrase, and derive the same keys from them
+// only if they started with the same passphrase. Neither the passphrase nor
+// anything that could be used to guess it offline crosses the wire.
+type spake2 struct {
+	role role
+
+	// w is the scalar derived from the passphrase.
+	w *big.Int
+
+	// secret is this machine's ephemeral private scalar.
+	secret *big.Int
+
+	// share is what this machine sends to the other one.
+	share []byte
+}
+
+// sessionKeys are the keys that both machines derive from a SPAKE2 exchange.
+type sessionKeys struct {
+	// key is the shared secret that authenticates the rest of the session.
+	key []byte
+
+	// senderConfirmation and receiverConfirmation are the MACs that the
+	// sender and receiver send each other to prove that they derived the
+	// same keys.
+	senderConfirmation   []byte
+	receiverConfirmation []byte
+
+	// peerIdentity is the public key of the paired device on the other end of
+	// the exchange, and signed is what it signs to confirm the keys. Both are
+	// empty if the exchange was authenticated with a passphrase instead.
+	peerIdentity ed25519.PublicKey
+	signed       []byte
+}
+
+// confirms returns true if the provided confirmation, which was sent by the
+// machine on the provided side of the handshake, proves that it derived the
+// same keys as us.
+func (k *sessionKeys) confirms(r role, confirmation []byte) bool {
+	if k.peerIdentity != nil {
+		return ed25519.Verify(k.peerIdentity, signedMessage(r, k.signed),
+			confirmation)
+	}
+	if r == roleReceiver {
+		return hmac.Equal(confirmation, k.receiverConfirmation)
+	}
+	return hmac.Equal(confirmation, k.senderConfirmation)
+}
+
+// newSPAKE2 returns a pointer to a new spake2 struct for the provided side of
+// the handshake, with a new random share blinded with the provided passphrase.
+func newSPAKE2(r role, passphrase string) (*spake2, error) {
+	n := curve.Params().N
+	digest := sha512.Sum512([]byte(passphrase))
+	w := new(big.Int).Mod(new(big.Int).SetBytes(digest[:]), n)
+
+	// Pick a secret in [1, n).
+	secret, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	secret.Add(secret, big.NewInt(1))
+
+	blindX, blindY := pointMX, pointMY
+	if r == roleReceiver {
+		blindX, blindY = pointNX, pointNY
+	}
+	x, y := curve.ScalarBaseMult(scalarBytes(secret))
+	bx, by := curve.ScalarMult(blindX, blindY, scalarBytes(w))
+	x, y = curve.Add(x, y, bx, by)
+
+	return &spake2{r, w, secret, elliptic.Marshal(curve, x, y)}, nil
+}
+
+// finish derives the session's keys from the other machine's share. context is
+// mixed into the confirmation keys, so that both machines only confirm each
+// other if they agree on it, too.
+func (s *spake2) finish(peerShare, context []byte) (*sessionKeys, error) {
+	px, py := elliptic.Unmarshal(curve, peerShare)
+	if px == nil {
+		return nil, errors.New("share isn't a point on the curve")
+	}
+
+	// Remove the passphrase's blinding from the other machine's share, then
+	// multiply it by our secret.
+	blindX, blindY := pointNX, pointNY
+	if s.role == roleReceiver {
+		blindX, blindY = pointMX, pointMY
+	}
+	bx, by := curve.ScalarMult(blindX, blindY, scalarBytes(s.w))
+	by.Sub(curve.Params().P, by)
+	zx, zy := curve.Add(px, py, bx, by)
+	kx, ky := curve.ScalarMult(zx, zy, scalarBytes(s.secret))
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, errors.New("share is invalid")
+	}
+
+	senderShare, receiverShare := s.share, peerShare
+	if s.role == roleReceiver {
+		senderShare, receiverShare = peerShare, s.share
+	}
+	transcript := encodeTranscript(
+		senderIdentity,
+		receiverIdentity,
+		senderShare,
+		receiverShare,
+		elliptic.Marshal(curve, kx, ky),
+		scalarBytes(s.w),
+	)
+
+	digest := sha512.Sum512(transcript)
+	key, confirmationKey := digest[:32], digest[32:]
+	confirmationKeys := hkdf(confirmationKey,
+		append([]byte("ConfirmationKeys"), context...), 64)
+
+	return &sessionKeys{
+		key:                  key,
+		senderConfirmation:   mac(confirmationKeys[:32], transcript),
+		receiverConfirmation: mac(confirmationKeys[32:], transcript),
+	}, nil
+}
+
+// encodeTranscript encodes the provided fields, each one preceded by its
+// length, so that no two lists of fields encode the same way.
+func encodeTranscript(fields ...[]byte) []byte {
+	transcript := new(bytes.Buffer)
+	for _, field := range fields {
+		binary.Write(transcript, binary.LittleEndian, uint64(len(field)))
+		transcript.Write(field)
+	}
+
+	return transcript.Bytes()
+}
+
+// scalarBytes returns the provided scalar as a 32-byte big-endian integer.
+func scalarBytes(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, 32))
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// hkdf derives length bytes from secret and info with HKDF-SHA256, as
+// described in RFC 5869, with an empty salt.
+func hkdf(secret, info []byte, length int) []byte {
+	prk := mac(make([]byte, sha256.Size), secret)
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		block = mac(prk, append(append(append([]byte{}, block...), info...),
+			i))
+		out = append(out, block...)
+	}
+
+	return out[:length]
+}
@@ -0,0 +1,93 @@
+package handshake
+
+import (
+	"bytes"
+	"testing"
+)
+
+// exchange runs both sides of a SPAKE2 exchange with the provided passphrases.
+func exchange(
+	t *testing.T,
+	senderPassphrase, receiverPassphrase string,
+	senderContext, receiverContext []byte,
+) (*sessionKeys, *sessionKeys) {
+	sender, err := newSPAKE2(roleSender, senderPassphrase)
+	if err != nil {
+		t.Fatalf("unexpected error beginning sender's exchange: %v", err)
+	}
+	receiver, err := newSPAKE2(roleReceiver, receiverPassphrase)
+	if err != nil {
+		t.Fatalf("unexpected error beginning receiver's exchange: %v", err)
+	}
+	senderKeys, err := sender.finish(receiver.share, senderContext)
+	if err != nil {
+		t.Fatalf("unexpected error finishing sender's exchange: %v", err)
+	}
+	receiverKeys, err := receiver.finish(sender.share, receiverContext)
+	if err != nil {
+		t.Fatalf("unexpected error finishing receiver's exchange: %v", err)
+	}
+
+	return senderKeys, receiverKeys
+}
+
+func TestSPAKE2SamePassphrase(t *testing.T) {
+	context := encodeContext(SupportedCapabilities, CapabilityCompression)
+	senderKeys, receiverKeys := exchange(t, "tracker", "tracker", context,
+		context)
+
+	if !bytes.Equal(senderKeys.key, receiverKeys.key) {
+		t.Fatal("expected both machines to derive the same key")
+	}
+	if !bytes.Equal(senderKeys.senderConfirmation,
+		receiverKeys.senderConfirmation) {
+		t.Fatal("expected both machines to derive the same sender" +
+			" confirmation")
+	}
+	if !bytes.Equal(senderKeys.receiverConfirmation,
+		receiverKeys.receiverConfirmation) {
+		t.Fatal("expected both machines to derive the same receiver" +
+			" confirmation")
+	}
+	if bytes.Equal(senderKeys.senderConfirmation,
+		senderKeys.receiverConfirmation) {
+		t.Fatal("expected the sender and receiver confirmations to differ")
+	}
+}
+
+func TestSPAKE2DifferentPassphrase(t *testing.T) {
+	senderKeys, receiverKeys := exchange(t, "tracker", "trucker", nil, nil)
+
+	if bytes.Equal(senderKeys.key, receiverKeys.key) {
+		t.Fatal("expected machines with different passphrases to derive" +
+			" different keys")
+	}
+	if bytes.Equal(senderKeys.receiverConfirmation,
+		receiverKeys.receiverConfirmation) {
+		t.Fatal("expected machines with different passphrases to derive" +
+			" different confirmations")
+	}
+}
+
+func TestSPAKE2DifferentContext(t *testing.T) {
+	senderKeys, receiverKeys := exchange(t, "tracker", "tracker",
+		encodeContext(SupportedCapabilities, SupportedCapabilities),
+		encodeContext(SupportedCapabilities, CapabilityCompression))
+
+	if bytes.Equal(senderKeys.receiverConfirmation,
+		receiverKeys.receiverConfirmation) {
+		t.Fatal("expected machines with different contexts to derive" +
+			" different confirmations")
+	}
+}
+
+func TestSPAKE2RejectsInvalidShare(t *testing.T) {
+	sender, err := newSPAKE2(roleSender, "tracker")
+	if err != nil {
+		t.Fatalf("unexpected error beginning exchange: %v", err)
+	}
+
+	if _, err := sender.finish([]byte("not a point"), nil); err == nil {
+		t.Fatal("expected an error finishing with an invalid share")
+	}
+}
@@ -1,7 +1,6 @@
 package input
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"strings"
@@ -24,7 +23,8 @@ type Capturer struct {
 	inputReader io.Reader
 
 	// promptWriter is the Writer interface where prompts for input are printed/
-	// written. Should be os.Stdout in production. Helpful when writing tests.
+	// written. Should be os.Stderr in production, so that prompts are displayed
+	// even if stdout is being piped someplace else. Helpful when writing tests.
 	promptWriter io.Writer
 }
 
@@ -49,22 +49,53 @@ func NewCapturer(
 // CapturePassphrase prompts the user to enter the passphrase that's displayed
 // on the other machine running lancp, and returns their input.
 func (c *Capturer) CapturePassphrase() (string, error) {
-	inputReader := bufio.NewReader(c.inputReader)
-
 	// The log pkg doesn't let you print without a newline char at the end.
 	fmt.Fprintf(c.promptWriter,
 		"Enter the passphrase displayed on the %s's machine:\n%s ",
 		c.machineName, c.caretCharacter)
 
-	userInput, err := inputReader.ReadString('\n')
+	return c.readLine()
+}
+
+// CaptureConfirmation asks the user the provided yes or no question, and
+// returns true if they answer yes. Anything other than "y" or "yes" counts as
+// no.
+func (c *Capturer) CaptureConfirmation(question string) (bool, error) {
+	fmt.Fprintf(c.promptWriter, "%s [y/N]\n%s ", question, c.caretCharacter)
+
+	userInput, err := c.readLine()
 	if err != nil {
-		// TODO: Should we handle the case where err == io.EOF differently?
-		return "", err
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(userInput)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
 	}
+}
 
-	// Convert all CRLF line endings to LF endings.
-	userInput = strings.TrimSuffix(userInput, "\r\n")
-	userInput = strings.TrimSuffix(userInput, "\n")
+// readLine reads one line of user input, without its line ending.
+func (c *Capturer) readLine() (string, error) {
+	// Read one byte at a time instead of buffering, so that nothing past the
+	// end of this line is read. Otherwise, it'd be lost to the next prompt.
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := c.inputReader.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			// TODO: Should we handle the case where err == io.EOF
+			// differently?
+			return "", err
+		}
+	}
 
-	return userInput, nil
+	// Convert all CRLF line endings to LF endings.
+	return strings.TrimSuffix(string(line), "\r"), nil
 }
@@ -0,0 +1,18 @@
+package input
+
+import (
+	"os"
+	"runtime"
+)
+
+// OpenTerminal opens the terminal that lancp is running in for reading. Useful
+// for prompting the user for input when stdin is being used for something else,
+// like when data is piped into lancp.
+func OpenTerminal() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+
+	return os.Open(name)
+}
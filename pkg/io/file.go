@@ -1,13 +1,12 @@
 package io
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io"
-	_net "net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 // TODO: make these user-configurable.
@@ -18,51 +17,129 @@ const progressBarLen = 40 // # of characters.
 // then it appends " (x)" to the file name, where x is the lowest revision
 // number possible.
 func CreateNewFileOnDisk(name string) (*os.File, error) {
-	file, err := os.OpenFile(
-		name,
-		os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666,
-	)
+	var file *os.File
+	_, err := createWithUniqueName(name, filepath.Ext(name), func(
+		name string,
+	) error {
+		var err error
+		file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		return err
+	})
+
+	return file, err
+}
+
+// CreateNewDirOnDisk attempts to create a new directory in the user's current
+// directory. If a file or directory already exists with the same name, then it
+// appends " (x)" to the directory name, where x is the lowest revision number
+// possible.
+//
+// Returns the name of the directory that was created.
+func CreateNewDirOnDisk(name string) (string, error) {
+	// Directory names don't have extensions, even if they have a "." in them.
+	return createWithUniqueName(name, "", func(name string) error {
+		return os.Mkdir(name, 0777)
+	})
+}
+
+// createWithUniqueName calls create with the provided name. If something with
+// that name already exists, it keeps adding a suffix before the provided
+// extension and calling create again until it gets a non-existent name.
+//
+// Returns the name that create succeeded with.
+func createWithUniqueName(
+	name, ext string,
+	create func(name string) error,
+) (string, error) {
+	err := create(name)
 
-	// If another file with that name already exists, keep adding a suffix until
-	// we get a non-existent file name.
 	versionNum := 1
+	basename := strings.TrimSuffix(name, ext)
+	candidate := name
 	for os.IsExist(err) {
-		ext := filepath.Ext(name)
-		basename := strings.TrimSuffix(name, ext)
-
-		file, err = os.OpenFile(
-			fmt.Sprintf("%s (%d)%s", basename, versionNum, ext),
-			os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666,
-		)
+		candidate = fmt.Sprintf("%s (%d)%s", basename, versionNum, ext)
+		err = create(candidate)
 
 		versionNum++
 	}
 
-	return file, err
+	return candidate, err
 }
 
-// ReceiveFileFromConn reads a payload sent along the provided network
-// connection and writes it to a file.
+// ReceiveFileFromConn reads a payload of the provided size sent along a network
+// connection and writes it to a file. If size is negative, it reads until the
+// connection reaches EOF. Returns the number of bytes written.
 //
 // TODO: implement timeout and retry logic.
-func ReceiveFileFromConn(file *os.File, size int64, conn _net.Conn) error {
-	progressReader := getProgressReader(size, conn, progressBarLen)
-	_, err := io.Copy(file, progressReader)
-	return err
+func ReceiveFileFromConn(
+	file io.Writer,
+	size int64,
+	conn io.Reader,
+) (int64, error) {
+	if size < 0 {
+		return io.Copy(file, conn)
+	}
+	return io.CopyN(file, conn, size)
 }
 
+// SendFileAlongConn reads a payload of the provided size from a file and writes
+// it to a network connection. If size is negative, it reads until the file
+// reaches EOF.
+//
 // TODO: implement timeout and retry logic.
-// TODO: draw progress with ioprogress pkg.
-func SendFileAlongConn(file *os.File, size int64, conn *tls.Conn) error {
-	progressReader := getProgressReader(size, file, progressBarLen)
-	_, err := io.Copy(conn, progressReader)
+func SendFileAlongConn(file io.Reader, size int64, conn io.Writer) error {
+	var err error
+	if size < 0 {
+		_, err = io.Copy(conn, file)
+	} else {
+		_, err = io.CopyN(conn, file, size)
+	}
 	return err
 }
 
-// This ought to be in the standard library imo.
-func min(x, y int64) int64 {
-	if x < y {
-		return x
+// SectionWriter is an io.Writer that writes to an underlying WriterAt, starting
+// at a particular offset. Several SectionWriters can write to different parts
+// of the same file at the same time.
+type SectionWriter struct {
+	w io.WriterAt
+
+	// off must only be accessed atomically, since Offset can be called while
+	// another goroutine is writing.
+	off int64
+}
+
+// NewSectionWriter returns a pointer to a new SectionWriter struct which starts
+// writing to w at the provided offset.
+func NewSectionWriter(w io.WriterAt, off int64) *SectionWriter {
+	return &SectionWriter{w, off}
+}
+
+// Write writes p to the underlying WriterAt, right after whatever was written
+// last.
+func (sw *SectionWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.WriteAt(p, atomic.LoadInt64(&sw.off))
+	atomic.AddInt64(&sw.off, int64(n))
+	return n, err
+}
+
+// Offset returns the offset that the next call to Write will write to. It's
+// safe to call while another goroutine is writing.
+func (sw *SectionWriter) Offset() int64 {
+	return atomic.LoadInt64(&sw.off)
+}
+
+// FormatSize returns the provided number of bytes in a human-readable format,
+// like "4.2 MB".
+func FormatSize(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
 	}
-	return y
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
 }
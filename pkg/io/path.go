@@ -1,6 +1,15 @@
 package io
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StdinPath is the path that users can provide to send whatever is piped into
+// lancp's stdin.
+const StdinPath = "-"
 
 // IsFileAccessible checks if a file exists and if we have permissions to read
 // it.
@@ -8,3 +17,48 @@ func IsFileAccessible(path string) error {
 	_, err := os.Stat(path)
 	return err
 }
+
+// ExpandPaths checks that every provided path is accessible. Paths that don't
+// exist but contain glob patterns (like "*.csv") are replaced with the paths
+// that they match. Useful when the user's shell doesn't expand globs for them.
+//
+// StdinPath is left as-is. Any other path that's provided more than once, or
+// that more than one pattern matches, only appears once in the result.
+func ExpandPaths(paths []string) ([]string, error) {
+	var expanded []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if key := filepath.Clean(path); !seen[key] {
+			seen[key] = true
+			expanded = append(expanded, path)
+		}
+	}
+	for _, path := range paths {
+		if path == StdinPath {
+			expanded = append(expanded, path)
+			continue
+		}
+
+		err := IsFileAccessible(path)
+		if err == nil {
+			add(path)
+			continue
+		}
+		if !os.IsNotExist(err) || !strings.ContainsAny(path, "*?[") {
+			return nil, err
+		}
+
+		matches, globErr := filepath.Glob(path)
+		if globErr != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", path, globErr)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", path)
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,72 @@
+package io
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancp-paths")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.csv", "b.csv", "[x].txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error writing %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		paths   []string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"a.csv", StdinPath}, []string{"a.csv", StdinPath}, false},
+		{[]string{"*.csv"}, []string{"a.csv", "b.csv"}, false},
+		// Exists, so it isn't treated as a pattern, which would match x.txt.
+		{[]string{"[x].txt"}, []string{"[x].txt"}, false},
+		{[]string{"*.csv", "a.*"}, []string{"a.csv", "b.csv"}, false},
+		{[]string{"b.csv", "*.csv"}, []string{"b.csv", "a.csv"}, false},
+		{[]string{"a.csv", "./a.csv"}, []string{"a.csv"}, false},
+		{[]string{"a.csv", "*.json"}, nil, true},
+		{[]string{"c.csv"}, nil, true},
+		{[]string{"[.csv"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		var paths, want []string
+		for _, path := range tt.paths {
+			if path != StdinPath {
+				path = dir + string(filepath.Separator) + path
+			}
+			paths = append(paths, path)
+		}
+		for _, path := range tt.want {
+			if path != StdinPath {
+				path = dir + string(filepath.Separator) + path
+			}
+			want = append(want, path)
+		}
+
+		got, err := ExpandPaths(paths)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("expected an error expanding %v, got nil", tt.paths)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error expanding %v: %v", tt.paths, err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected result for %v, got: %v\nwant: %v", tt.paths,
+				got, want)
+		}
+	}
+}
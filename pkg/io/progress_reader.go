@@ -1,16 +1,85 @@
 package io
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/alsm/ioprogress"
 )
 
+// ProgressBar displays a single progress bar to stderr that tracks the
+// progress of reads from one or more sources. Useful when several files are
+// being transferred, but the user only cares about the transfer as a whole.
+type ProgressBar struct {
+	// mu guards reader, since the sources that the progress bar tracks can be
+	// read from concurrently.
+	mu     sync.Mutex
+	reader *ioprogress.Reader
+}
+
+// NewProgressBar returns a pointer to a new ProgressBar struct that expects
+// size bytes to be read in total. If size is negative, the total isn't known
+// ahead of time, so it only displays how many bytes have been read so far.
+func NewProgressBar(size int64) *ProgressBar {
+	return &ProgressBar{reader: getProgressReader(size, nil, progressBarLen)}
+}
+
+// Track returns a Reader which, when read from, reads from the provided Reader
+// and advances the progress bar. It's safe to read from Readers returned by
+// several calls to Track at the same time.
+func (b *ProgressBar) Track(reader io.Reader) io.Reader {
+	return &trackedReader{reader, b}
+}
+
+// Finish draws the progress bar one last time, then moves on to a new line.
+func (b *ProgressBar) Finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// ioprogress only finishes drawing a progress bar once its underlying
+	// Reader hits EOF, which our callers never read far enough to see.
+	b.reader.Reader = strings.NewReader("")
+	b.reader.Read(nil)
+}
+
+// advance moves the progress bar forward by the number of bytes in p, which
+// were just read from one of the sources it tracks.
+func (b *ProgressBar) advance(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// ioprogress only counts bytes that are read through it, so read p back
+	// into itself.
+	b.reader.Reader = bytes.NewReader(p)
+	io.ReadFull(b.reader, p)
+}
+
+// trackedReader advances a progress bar as it's read from.
+type trackedReader struct {
+	reader io.Reader
+	bar    *ProgressBar
+}
+
+func (r *trackedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bar.advance(p[:n])
+	return n, err
+}
+
 // getProgressReader returns a new Reader which, when read from, will display
 // a progress bar to stderr.
-func getProgressReader(size int64, reader io.Reader, barLen uint) io.Reader {
+func getProgressReader(
+	size int64,
+	reader io.Reader,
+	barLen uint,
+) *ioprogress.Reader {
 	// progressReader is an io.Reader, and will write the progress of a read to
 	// stdout in real time.
 	//
@@ -25,6 +94,9 @@ func getProgressReader(size int64, reader io.Reader, barLen uint) io.Reader {
 		DrawFunc: ioprogress.DrawTerminalf(
 			os.Stderr,
 			func(progress, total int64) string {
+				if total < 0 {
+					return FormatSize(progress)
+				}
 				return fmt.Sprintf(
 					"%s %s",
 					bar(progress, total),
@@ -0,0 +1,380 @@
+package mdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	_net "net"
+	"strings"
+)
+
+// DNS record types that lancp knows about. Records of any other type are
+// skipped over when they're decoded.
+const (
+	typeA    uint16 = 1
+	typePTR  uint16 = 12
+	typeTXT  uint16 = 16
+	typeAAAA uint16 = 28
+	typeSRV  uint16 = 33
+	typeANY  uint16 = 255
+)
+
+const (
+	// classIN is the Internet class, which every mDNS record is in.
+	classIN uint16 = 1
+
+	// unicastResponseBit is set in a question's class when the querier wants
+	// a unicast response. In an answer, the same bit is the cache flush bit,
+	// which says that the record replaces any other records with its name and
+	// type.
+	unicastResponseBit uint16 = 1 << 15
+
+	// flagResponse marks a message as a response, and flagAuthoritative marks
+	// it as coming from the machine that the records are about.
+	flagResponse      uint16 = 1 << 15
+	flagAuthoritative uint16 = 1 << 10
+
+	// headerLen is the number of bytes in a DNS message's header.
+	headerLen = 12
+
+	// maxPointers is the most compression pointers that a single name is
+	// allowed to follow, so that a malicious message can't send us around in
+	// circles.
+	maxPointers = 16
+)
+
+// message is a DNS message, as sent over multicast DNS.
+// https://datatracker.ietf.org/doc/html/rfc6762
+type message struct {
+	id        uint16
+	response  bool
+	questions []question
+
+	// answers and additionals are the records in the message's answer and
+	// additional sections. Authority records are never sent, and are ignored
+	// when they're received.
+	answers     []record
+	additionals []record
+}
+
+// question asks for records with a name and type.
+type question struct {
+	name  string
+	qtype uint16
+
+	// unicast is true if the querier asked for a unicast response.
+	unicast bool
+}
+
+// record is a DNS resource record. Which of its data fields are set depends on
+// its type.
+type record struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+
+	// cacheFlush is true if the record replaces any other records with the
+	// same name and type.
+	cacheFlush bool
+
+	// target is the name that a PTR record points to, or the host that an SRV
+	// record's service is on.
+	target string
+
+	// port is the port that an SRV record's service listens on.
+	port uint16
+
+	// txt are the strings in a TXT record.
+	txt []string
+
+	// ip is the address in an A or AAAA record.
+	ip _net.IP
+}
+
+// encodeMessage encodes the provided DNS message in its wire format. Names are
+// never compressed, which every DNS decoder understands.
+func encodeMessage(m *message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var flags uint16
+	if m.response {
+		flags = flagResponse | flagAuthoritative
+	}
+	for _, field := range []uint16{
+		m.id,
+		flags,
+		uint16(len(m.questions)),
+		uint16(len(m.answers)),
+		0,
+		uint16(len(m.additionals)),
+	} {
+		binary.Write(buf, binary.BigEndian, field)
+	}
+
+	for _, q := range m.questions {
+		if err := writeName(buf, q.name); err != nil {
+			return nil, err
+		}
+		class := classIN
+		if q.unicast {
+			class |= unicastResponseBit
+		}
+		binary.Write(buf, binary.BigEndian, q.qtype)
+		binary.Write(buf, binary.BigEndian, class)
+	}
+	for _, r := range append(append([]record{}, m.answers...),
+		m.additionals...) {
+		if err := writeRecord(buf, &r); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeName writes the provided name to buf as a sequence of labels, each
+// preceded by its length, and ending with an empty label.
+func writeName(buf *bytes.Buffer, name string) error {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("invalid DNS name %q", name)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+
+	return nil
+}
+
+// writeRecord writes the provided resource record to buf.
+func writeRecord(buf *bytes.Buffer, r *record) error {
+	data := new(bytes.Buffer)
+	switch r.rtype {
+	case typePTR:
+		if err := writeName(data, r.target); err != nil {
+			return err
+		}
+	case typeSRV:
+		// Priority and weight don't mean anything when there's only one
+		// instance with the name.
+		binary.Write(data, binary.BigEndian, [3]uint16{0, 0, r.port})
+		if err := writeName(data, r.target); err != nil {
+			return err
+		}
+	case typeTXT:
+		for _, s := range r.txt {
+			if len(s) > 255 {
+				return fmt.Errorf("TXT record string %q is too long", s)
+			}
+			data.WriteByte(byte(len(s)))
+			data.WriteString(s)
+		}
+		// A TXT record always has at least one string, even if it's empty.
+		if len(r.txt) == 0 {
+			data.WriteByte(0)
+		}
+	case typeA:
+		data.Write(r.ip.To4())
+	case typeAAAA:
+		data.Write(r.ip.To16())
+	default:
+		return fmt.Errorf("can't encode DNS records of type %d", r.rtype)
+	}
+
+	if err := writeName(buf, r.name); err != nil {
+		return err
+	}
+	class := classIN
+	if r.cacheFlush {
+		class |= unicastResponseBit
+	}
+	binary.Write(buf, binary.BigEndian, r.rtype)
+	binary.Write(buf, binary.BigEndian, class)
+	binary.Write(buf, binary.BigEndian, r.ttl)
+	binary.Write(buf, binary.BigEndian, uint16(data.Len()))
+	buf.Write(data.Bytes())
+
+	return nil
+}
+
+// decodeMessage decodes a DNS message from its wire format. Records of types
+// that lancp doesn't know about are skipped over.
+func decodeMessage(payload []byte) (*message, error) {
+	if len(payload) < headerLen {
+		return nil, errors.New("DNS message is too short")
+	}
+	var header [6]uint16
+	for i := range header {
+		header[i] = binary.BigEndian.Uint16(payload[2*i:])
+	}
+	m := &message{id: header[0], response: header[1]&flagResponse != 0}
+
+	d := &decoder{payload, headerLen}
+	for i := 0; i < int(header[2]); i++ {
+		name, err := d.readName()
+		if err != nil {
+			return nil, err
+		}
+		fields, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		class := binary.BigEndian.Uint16(fields[2:])
+		m.questions = append(m.questions, question{
+			name:    name,
+			qtype:   binary.BigEndian.Uint16(fields),
+			unicast: class&unicastResponseBit != 0,
+		})
+	}
+	for section := 3; section < len(header); section++ {
+		for i := 0; i < int(header[section]); i++ {
+			r, err := d.readRecord()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case r == nil || section == 4:
+				// Either we don't know about its type, or it's an authority
+				// record.
+			case section == 3:
+				m.answers = append(m.answers, *r)
+			default:
+				m.additionals = append(m.additionals, *r)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// decoder reads the pieces of a DNS message one after another.
+type decoder struct {
+	payload []byte
+
+	// offset is where in payload the next piece begins.
+	offset int
+}
+
+// read returns the next n bytes of the message.
+func (d *decoder) read(n int) ([]byte, error) {
+	if n < 0 || d.offset+n > len(d.payload) {
+		return nil, errors.New("DNS message is truncated")
+	}
+	b := d.payload[d.offset : d.offset+n]
+	d.offset += n
+
+	return b, nil
+}
+
+// readName reads the next name in the message, following any compression
+// pointers in it.
+func (d *decoder) readName() (string, error) {
+	var labels []string
+	offset := d.offset
+	// end is where the name ends in the message, which is right after the
+	// first compression pointer, if there is one.
+	end := -1
+	for pointers := 0; ; {
+		if offset >= len(d.payload) {
+			return "", errors.New("DNS message is truncated")
+		}
+		length := int(d.payload[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			d.offset = end
+			return strings.Join(labels, "."), nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(d.payload) {
+				return "", errors.New("DNS message is truncated")
+			}
+			if pointers++; pointers > maxPointers {
+				return "", errors.New("DNS name has too many compression" +
+					" pointers")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(d.payload[offset:]) & 0x3fff)
+		case length > 63:
+			return "", fmt.Errorf("DNS label is %d bytes long", length)
+		default:
+			if offset+1+length > len(d.payload) {
+				return "", errors.New("DNS message is truncated")
+			}
+			labels = append(labels,
+				string(d.payload[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// readRecord reads the next resource record in the message. It returns nil if
+// the record's type isn't one that lancp knows about.
+func (d *decoder) readRecord() (*record, error) {
+	name, err := d.readName()
+	if err != nil {
+		return nil, err
+	}
+	fields, err := d.read(10)
+	if err != nil {
+		return nil, err
+	}
+	r := &record{
+		name:       name,
+		rtype:      binary.BigEndian.Uint16(fields),
+		cacheFlush: binary.BigEndian.Uint16(fields[2:])&unicastResponseBit != 0,
+		ttl:        binary.BigEndian.Uint32(fields[4:]),
+	}
+	dataLen := int(binary.BigEndian.Uint16(fields[8:]))
+	dataStart := d.offset
+	data, err := d.read(dataLen)
+	if err != nil {
+		return nil, err
+	}
+
+	// Names in the record's data can point anywhere in the message, so they
+	// need to be read from the message itself.
+	nameDecoder := &decoder{d.payload, dataStart}
+	switch r.rtype {
+	case typePTR:
+		if r.target, err = nameDecoder.readName(); err != nil {
+			return nil, err
+		}
+	case typeSRV:
+		if dataLen < 6 {
+			return nil, errors.New("SRV record is too short")
+		}
+		r.port = binary.BigEndian.Uint16(data[4:])
+		nameDecoder.offset += 6
+		if r.target, err = nameDecoder.readName(); err != nil {
+			return nil, err
+		}
+	case typeTXT:
+		for len(data) > 0 {
+			length := int(data[0])
+			if 1+length > len(data) {
+				return nil, errors.New("TXT record is truncated")
+			}
+			r.txt = append(r.txt, string(data[1:1+length]))
+			data = data[1+length:]
+		}
+	case typeA:
+		if dataLen != _net.IPv4len {
+			return nil, fmt.Errorf("A record is %d bytes long", dataLen)
+		}
+		r.ip = _net.IP(append([]byte{}, data...))
+	case typeAAAA:
+		if dataLen != _net.IPv6len {
+			return nil, fmt.Errorf("AAAA record is %d bytes long", dataLen)
+		}
+		r.ip = _net.IP(append([]byte{}, data...))
+	default:
+		return nil, nil
+	}
+
+	return r, nil
+}
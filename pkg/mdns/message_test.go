@@ -0,0 +1,93 @@
+package mdns
+
+import (
+	_net "net"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	want := &message{
+		id:       0x6c61,
+		response: true,
+		questions: []question{
+			{name: "_lancp._tcp.local", qtype: typePTR, unicast: true},
+		},
+		answers: []record{
+			{name: "_lancp._tcp.local", rtype: typePTR, ttl: ttl,
+				target: "box._lancp._tcp.local"},
+		},
+		additionals: []record{
+			{name: "box._lancp._tcp.local", rtype: typeSRV, ttl: ttl,
+				cacheFlush: true, target: "lancp-00.local", port: 6969},
+			{name: "box._lancp._tcp.local", rtype: typeTXT, ttl: ttl,
+				cacheFlush: true, txt: []string{"protovers=4", ""}},
+			{name: "lancp-00.local", rtype: typeA, ttl: ttl,
+				ip: _net.ParseIP("192.168.0.69").To4()},
+			{name: "lancp-00.local", rtype: typeAAAA, ttl: ttl,
+				ip: _net.ParseIP("fe80::69")},
+		},
+	}
+
+	payload, err := encodeMessage(want)
+	if err != nil {
+		t.Fatalf("unexpected error encoding message: %v", err)
+	}
+	got, err := decodeMessage(payload)
+	if err != nil {
+		t.Fatalf("unexpected error decoding message: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected message, got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestDecodeMessageCompressedNames(t *testing.T) {
+	payload := []byte{
+		0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0,
+		// _lancp._tcp.local PTR, with the name at offset 12.
+		6, '_', 'l', 'a', 'n', 'c', 'p', 4, '_', 't', 'c', 'p',
+		5, 'l', 'o', 'c', 'a', 'l', 0,
+		0, 12, 0, 1, 0, 0, 0, 10, 0, 6,
+		// box, followed by a pointer back to _lancp._tcp.local.
+		3, 'b', 'o', 'x', 0xc0, 12,
+	}
+
+	m, err := decodeMessage(payload)
+	if err != nil {
+		t.Fatalf("unexpected error decoding message: %v", err)
+	}
+	if len(m.answers) != 1 {
+		t.Fatalf("unexpected number of answers, got: %d\nwant: 1",
+			len(m.answers))
+	}
+	if got := m.answers[0].target; got != "box._lancp._tcp.local" {
+		t.Fatalf("unexpected target, got: %s\nwant: box._lancp._tcp.local",
+			got)
+	}
+}
+
+func TestDecodeMessageInvalid(t *testing.T) {
+	payload, err := encodeMessage(&message{
+		questions: []question{{name: "_lancp._tcp.local", qtype: typePTR}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error encoding message: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+	}{
+		{"too short", payload[:headerLen-1]},
+		{"truncated", payload[:len(payload)-1]},
+		{"pointer loop", []byte{
+			0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+			0xc0, 12, 0, 12, 0, 1,
+		}},
+	} {
+		if _, err := decodeMessage(tc.payload); err == nil {
+			t.Fatalf("expected an error decoding %s message", tc.name)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package mdns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	_net "net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// Service is an instance of a service that responded to a multicast DNS query.
+type Service struct {
+	// Instance is the instance's human-readable name.
+	Instance string
+
+	// Addr is the address that the instance listens on. It's the address
+	// that its response came from, with the port from its SRV record on the
+	// end.
+	Addr *_net.UDPAddr
+
+	// TXT are the strings in the instance's TXT record.
+	TXT []string
+}
+
+// Resolve sends a multicast DNS query for instances of the provided service,
+// like "_lancp._tcp.local", on every network interface that's up, and returns
+// every instance that responds within the provided timeout. If ifaceName isn't
+// empty, the query is only sent on the network interface with that name.
+//
+// The query is a one-shot query sent from a port other than the multicast DNS
+// port, so instances respond straight to us, and nothing needs to be listening
+// on the multicast DNS port on this machine.
+//
+// https://datatracker.ietf.org/doc/html/rfc6762#section-5.1
+func Resolve(
+	service, ifaceName string,
+	timeout time.Duration,
+) ([]Service, error) {
+	ifaces, err := net.GetInterfaces(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	var id uint16
+	if err = binary.Read(rand.Reader, binary.BigEndian, &id); err != nil {
+		return nil, err
+	}
+	query, err := encodeMessage(&message{
+		id:        id,
+		questions: []question{{name: service, qtype: typePTR, unicast: true}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the query from each of our addresses, so that it goes out on
+	// every network interface, even if there's no route to the multicast
+	// group.
+	var conns []*_net.UDPConn
+	var sendErr error = errors.New("no network interfaces support multicast")
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&_net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*_net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() {
+				continue
+			}
+			conn, err := sendQuery(query, iface, ipNet.IP)
+			if err != nil {
+				sendErr = err
+				continue
+			}
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("failed to send multicast DNS query: %v",
+			sendErr)
+	}
+
+	deadline := time.Now().Add(timeout)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var services []Service
+	seen := make(map[string]bool)
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *_net.UDPConn) {
+			defer wg.Done()
+			conn.SetReadDeadline(deadline)
+			buf := make([]byte, maxMessageLen)
+			for {
+				n, src, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				response, err := decodeMessage(buf[:n])
+				if err != nil || !response.response ||
+					(response.id != id && response.id != 0) {
+					continue
+				}
+
+				mu.Lock()
+				for _, s := range findServices(response, service, src) {
+					if !seen[s.Addr.String()] {
+						seen[s.Addr.String()] = true
+						services = append(services, s)
+					}
+				}
+				mu.Unlock()
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	return services, nil
+}
+
+// sendQuery sends the provided query to the multicast DNS group on the provided
+// network interface, from the provided address on that interface, and returns
+// the connection that responses will arrive on.
+func sendQuery(
+	query []byte,
+	iface *_net.Interface,
+	ip _net.IP,
+) (*_net.UDPConn, error) {
+	network := "udp6"
+	laddr := &_net.UDPAddr{IP: ip, Zone: iface.Name}
+	dst := &_net.UDPAddr{IP: groupIPv6, Port: port, Zone: iface.Name}
+	if ip.To4() != nil {
+		network = "udp4"
+		laddr.Zone = ""
+		dst = &_net.UDPAddr{IP: groupIPv4, Port: port}
+	}
+
+	conn, err := _net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.WriteToUDP(query, dst); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// findServices returns the instances of the provided service in the provided
+// response, which came from the provided address.
+func findServices(
+	response *message,
+	service string,
+	src *_net.UDPAddr,
+) []Service {
+	records := append(append([]record{}, response.answers...),
+		response.additionals...)
+	srvs := make(map[string]*record)
+	txts := make(map[string]*record)
+	for i := range records {
+		r := &records[i]
+		switch r.rtype {
+		case typeSRV:
+			srvs[strings.ToLower(r.name)] = r
+		case typeTXT:
+			txts[strings.ToLower(r.name)] = r
+		}
+	}
+
+	var services []Service
+	for _, r := range records {
+		if r.rtype != typePTR || !strings.EqualFold(r.name, service) {
+			continue
+		}
+		// Without an SRV record, there's no telling which port the instance
+		// listens on.
+		srv, ok := srvs[strings.ToLower(r.target)]
+		if !ok {
+			continue
+		}
+		s := Service{
+			Instance: r.target,
+			Addr: &_net.UDPAddr{
+				IP:   src.IP,
+				Port: int(srv.port),
+				Zone: src.Zone,
+			},
+		}
+		if suffix := "." + service; len(r.target) > len(suffix) &&
+			strings.EqualFold(r.target[len(r.target)-len(suffix):], suffix) {
+			s.Instance = r.target[:len(r.target)-len(suffix)]
+		}
+		if txt, ok := txts[strings.ToLower(r.target)]; ok {
+			s.TXT = txt.txt
+		}
+		services = append(services, s)
+	}
+
+	return services
+}
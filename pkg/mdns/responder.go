@@ -0,0 +1,305 @@
+package mdns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	_net "net"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nchaloult/lancp/pkg/net"
+)
+
+// port is the port that multicast DNS queries are sent to.
+const port = 5353
+
+const (
+	// ttl is how many seconds queriers may remember our records for. Services
+	// are only advertised for as long as a handshake lasts, so they shouldn't
+	// be remembered for long.
+	ttl = 10
+
+	// servicesName is asked about by queriers that want to know which
+	// services are advertised on the network, rather than where a particular
+	// one is.
+	servicesName = "_services._dns-sd._udp.local"
+
+	// maxMessageLen is the largest multicast DNS message that we'll read.
+	maxMessageLen = 9000
+)
+
+var (
+	groupIPv4 = _net.IPv4(224, 0, 0, 251)
+	groupIPv6 = _net.ParseIP("ff02::fb")
+)
+
+// Responder advertises an instance of a service over multicast DNS, answering
+// queries about it until it's closed.
+type Responder struct {
+	// service is the name of the service, like "_lancp._tcp.local", and
+	// instance is the full name of our instance of it.
+	service  string
+	instance string
+
+	// host is the name that the instance's address records are under. It's
+	// made up, so that it never clashes with the names that other software on
+	// this machine uses.
+	host string
+
+	// port is the port that the instance listens on, and txt are the strings
+	// in its TXT record.
+	port uint16
+	txt  []string
+
+	conns []*_net.UDPConn
+}
+
+// Advertise begins answering multicast DNS queries about an instance of the
+// provided service, like "_lancp._tcp.local", on every network interface that's
+// up. name is the instance's human-readable name, port is the port that it
+// listens on, and txt are the strings in its TXT record, which usually look
+// like "key=value".
+//
+// It shares the multicast DNS port with any other responders on this machine,
+// like the one that the operating system runs. Queries are answered in the
+// background until the returned Responder is closed.
+//
+// https://datatracker.ietf.org/doc/html/rfc6763
+func Advertise(
+	service, name string,
+	port int,
+	txt []string,
+) (*Responder, error) {
+	ifaces, err := net.GetInterfaces("")
+	if err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 4)
+	if _, err = rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	r := &Responder{
+		service:  strings.ToLower(service),
+		instance: cleanLabel(name) + "." + service,
+		host:     "lancp-" + hex.EncodeToString(suffix) + ".local",
+		port:     uint16(port),
+		txt:      txt,
+	}
+	var listenErr error
+	for _, group := range []_net.IP{groupIPv4, groupIPv6} {
+		conn, err := listenGroup(group, ifaces)
+		if err != nil {
+			listenErr = err
+			continue
+		}
+		r.conns = append(r.conns, conn)
+	}
+	if len(r.conns) == 0 {
+		return nil, fmt.Errorf("failed to listen for multicast DNS queries:"+
+			" %v", listenErr)
+	}
+	for _, conn := range r.conns {
+		go r.serve(conn)
+	}
+
+	return r, nil
+}
+
+// Close stops answering queries.
+func (r *Responder) Close() error {
+	var err error
+	for _, conn := range r.conns {
+		if closeErr := conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// listenGroup returns a connection that receives multicast DNS messages sent to
+// the provided group on each of the provided network interfaces that it can
+// join the group on.
+func listenGroup(
+	group _net.IP,
+	ifaces []_net.Interface,
+) (*_net.UDPConn, error) {
+	network := "udp6"
+	if group.To4() != nil {
+		network = "udp4"
+	}
+
+	var conn *_net.UDPConn
+	err := fmt.Errorf("no network interfaces support %s multicast", network)
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&_net.FlagMulticast == 0 {
+			continue
+		}
+		// Interfaces without an address of the group's kind can't join it,
+		// so keep trying until one can, then join it on every other one that
+		// can.
+		if conn == nil {
+			conn, err = _net.ListenMulticastUDP(network, iface,
+				&_net.UDPAddr{IP: group, Port: port})
+			continue
+		}
+		net.JoinGroup(conn, iface, group)
+	}
+	if conn == nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// serve answers the queries that arrive on the provided connection until it's
+// closed.
+func (r *Responder) serve(conn *_net.UDPConn) {
+	buf := make([]byte, maxMessageLen)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query, err := decodeMessage(buf[:n])
+		if err != nil || query.response {
+			continue
+		}
+		response, unicast := r.answer(query)
+		if response == nil {
+			continue
+		}
+
+		dst := src
+		if src.Port != port {
+			// Queriers that don't send from the multicast DNS port expect a
+			// plain DNS response, sent straight back to them.
+			response.id = query.id
+			response.questions = query.questions
+		} else if !unicast {
+			group := groupIPv6
+			if src.IP.To4() != nil {
+				group = groupIPv4
+			}
+			dst = &_net.UDPAddr{IP: group, Port: port, Zone: src.Zone}
+		}
+		payload, err := encodeMessage(response)
+		if err != nil {
+			continue
+		}
+		conn.WriteToUDP(payload, dst)
+	}
+}
+
+// answer returns a response with the records that answer the provided query,
+// and whether any of its questions asked for a unicast response. If it doesn't
+// ask about our instance, answer returns nil.
+func (r *Responder) answer(query *message) (*message, bool) {
+	var askedServices, askedService, askedInstance, askedHost, unicast bool
+	for _, q := range query.questions {
+		asked := true
+		switch name := strings.ToLower(q.name); {
+		case name == servicesName && isType(q.qtype, typePTR):
+			askedServices = true
+		case name == r.service && isType(q.qtype, typePTR):
+			askedService = true
+		case name == strings.ToLower(r.instance) &&
+			(isType(q.qtype, typeSRV) || isType(q.qtype, typeTXT)):
+			askedInstance = true
+		case name == r.host &&
+			(isType(q.qtype, typeA) || isType(q.qtype, typeAAAA)):
+			askedHost = true
+		default:
+			asked = false
+		}
+		unicast = unicast || (asked && q.unicast)
+	}
+	if !askedServices && !askedService && !askedInstance && !askedHost {
+		return nil, false
+	}
+
+	instanceRecords := []record{
+		{
+			name:       r.instance,
+			rtype:      typeSRV,
+			ttl:        ttl,
+			cacheFlush: true,
+			target:     r.host,
+			port:       r.port,
+		},
+		{
+			name:       r.instance,
+			rtype:      typeTXT,
+			ttl:        ttl,
+			cacheFlush: true,
+			txt:        r.txt,
+		},
+	}
+	var hostRecords []record
+	ips, _ := net.GetLocalAddrs()
+	for _, ip := range ips {
+		rtype := typeAAAA
+		if ip.To4() != nil {
+			rtype = typeA
+		}
+		hostRecords = append(hostRecords, record{
+			name:       r.host,
+			rtype:      rtype,
+			ttl:        ttl,
+			cacheFlush: true,
+			ip:         ip,
+		})
+	}
+
+	// Along with what was asked for, send the records that the querier is
+	// going to ask for next, so that it doesn't have to.
+	response := &message{response: true}
+	if askedServices {
+		response.answers = append(response.answers,
+			record{name: servicesName, rtype: typePTR, ttl: ttl,
+				target: r.service})
+	}
+	if askedService {
+		response.answers = append(response.answers,
+			record{name: r.service, rtype: typePTR, ttl: ttl,
+				target: r.instance})
+	}
+	if askedInstance {
+		response.answers = append(response.answers, instanceRecords...)
+	} else if askedService {
+		response.additionals = append(response.additionals,
+			instanceRecords...)
+	}
+	if askedHost {
+		response.answers = append(response.answers, hostRecords...)
+	} else if askedService || askedInstance {
+		response.additionals = append(response.additionals, hostRecords...)
+	}
+
+	return response, unicast
+}
+
+// isType returns true if a question of type qtype asks for records of type
+// rtype.
+func isType(qtype, rtype uint16) bool {
+	return qtype == rtype || qtype == typeANY
+}
+
+// cleanLabel turns the provided name into something that can be used as a
+// single DNS label: no dots, and no more than 63 bytes long.
+func cleanLabel(name string) string {
+	name = strings.ReplaceAll(name, ".", "-")
+	if name == "" {
+		name = "lancp"
+	}
+	// Trim off whole UTF-8 characters.
+	for len(name) > 63 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	return name
+}
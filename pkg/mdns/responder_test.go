@@ -0,0 +1,94 @@
+package mdns
+
+import (
+	_net "net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResponderAnswer(t *testing.T) {
+	r := &Responder{
+		service:  "_lancp._tcp.local",
+		instance: "box._lancp._tcp.local",
+		host:     "lancp-00.local",
+		port:     6969,
+		txt:      []string{"protovers=4"},
+	}
+
+	for _, tc := range []struct {
+		query           question
+		expectAnswer    bool
+		expectedUnicast bool
+	}{
+		{question{name: "_lancp._tcp.local", qtype: typePTR}, true, false},
+		{question{name: "_LANCP._tcp.local", qtype: typeANY, unicast: true},
+			true, true},
+		{question{name: "box._lancp._tcp.local", qtype: typeSRV}, true, false},
+		{question{name: servicesName, qtype: typePTR}, true, false},
+		{question{name: "_lancp._tcp.local", qtype: typeA}, false, false},
+		{question{name: "_http._tcp.local", qtype: typePTR}, false, false},
+	} {
+		response, unicast := r.answer(&message{
+			questions: []question{tc.query},
+		})
+		if (response != nil) != tc.expectAnswer {
+			t.Fatalf("unexpected response to %+v, got: %+v", tc.query,
+				response)
+		}
+		if unicast != tc.expectedUnicast {
+			t.Fatalf("unexpected unicast for %+v, got: %t\nwant: %t",
+				tc.query, unicast, tc.expectedUnicast)
+		}
+	}
+}
+
+func TestFindServices(t *testing.T) {
+	r := &Responder{
+		service:  "_lancp._tcp.local",
+		instance: "box._lancp._tcp.local",
+		host:     "lancp-00.local",
+		port:     6969,
+		txt:      []string{"protovers=4"},
+	}
+	response, _ := r.answer(&message{
+		questions: []question{{name: "_lancp._tcp.local", qtype: typePTR}},
+	})
+	src := &_net.UDPAddr{IP: _net.ParseIP("fe80::69"), Port: 5353,
+		Zone: "eth0"}
+
+	got := findServices(response, "_lancp._tcp.local", src)
+	want := []Service{{
+		Instance: "box",
+		Addr: &_net.UDPAddr{IP: _net.ParseIP("fe80::69"), Port: 6969,
+			Zone: "eth0"},
+		TXT: []string{"protovers=4"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected services, got: %+v\nwant: %+v", got, want)
+	}
+
+	// Without an SRV record, there's no port to connect to.
+	response.additionals = nil
+	if got := findServices(response, "_lancp._tcp.local", src); got != nil {
+		t.Fatalf("unexpected services without an SRV record, got: %+v", got)
+	}
+}
+
+func TestCleanLabel(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		expectedRes string
+	}{
+		{"box", "box"},
+		{"box.local", "box-local"},
+		{"", "lancp"},
+		{strings.Repeat("a", 64), strings.Repeat("a", 63)},
+		{strings.Repeat("a", 62) + "é", strings.Repeat("a", 62)},
+	} {
+		if got := cleanLabel(tc.name); got != tc.expectedRes {
+			t.Fatalf("unexpected label for %q, got: %q\nwant: %q", tc.name,
+				got, tc.expectedRes)
+		}
+	}
+}
@@ -1,95 +1,331 @@
 package net
 
 import (
+	"errors"
 	"fmt"
 	_net "net"
+	"strconv"
 	"strings"
 )
 
-// GetUDPBroadcastAddr builds a UDP address for the local network that this
-// machine is connected to. When a UDP message is sent to this address, every
-// device on the same local network will receive it (including the device who
-// originally sent the message!), and can read its message if they are listening
-// for these messages on the right port.
+// discoveryGroup is the IPv6 multicast group that lancp handshakes begin in.
+// It's link-local, so messages sent to it never leave the local network. The
+// last four bytes spell "lanc".
+const discoveryGroup = "ff02::6c61:6e63"
+
+// GetDiscoveryAddrs builds the UDP addresses that a message needs to be sent to
+// so that every device on the local networks that this machine is connected to
+// will receive it (including the device who originally sent the message!), and
+// can read its message if they are listening for these messages on the right
+// port.
+//
+// For each network interface that's up, other than loopback interfaces, that's
+// the directed broadcast address of each IPv4 network that the interface is on,
+// which depends on that network's netmask, along with the lancp IPv6 multicast
+// group on that interface if it has an IPv6 address. If ifaceName isn't empty,
+// only the interface with that name is used.
 // https://en.wikipedia.org/wiki/Broadcast_address
+// https://en.wikipedia.org/wiki/Multicast_address#IPv6
 //
-// It finds this device's preferred outbound IPv4 address, converts that into a
-// UDP broadcast address, and tacks on the provided port.
+// port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
+func GetDiscoveryAddrs(port, ifaceName string) ([]*_net.UDPAddr, error) {
+	portNum, err := GetPortAsInt(port)
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := GetInterfaces(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []*_net.UDPAddr
+	seen := make(map[string]bool)
+	for _, iface := range ifaces {
+		ipNets, err := getIPNets(&iface)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range getInterfaceDiscoveryAddrs(&iface, ipNets,
+			portNum) {
+			// Interfaces with self-assigned addresses, like a direct cable
+			// and a switch without a DHCP server, can be on the same
+			// 169.254.0.0/16 network, so they share a broadcast address.
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		if ifaceName != "" {
+			return nil, fmt.Errorf("network interface %s doesn't have an IPv4"+
+				" or IPv6 address to broadcast from", ifaceName)
+		}
+		return nil, errors.New("this device isn't connected to a network with" +
+			" an IPv4 or IPv6 address")
+	}
+	return addrs, nil
+}
+
+// ResolveHostAddrs returns the UDP addresses of the device with the provided
+// host name or IP address, so that a message can be sent straight to it instead
+// of being broadcast. That works even if the device is on another network, as
+// long as there's a route to it. IPv6 link-local addresses need a zone, like
+// "fe80::1%eth0". Host names are looked up with the system's resolver, and
+// every address that they resolve to is returned.
 //
 // port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
-func GetUDPBroadcastAddr(port string) (*_net.UDPAddr, error) {
-	localAddr, err := GetPreferredOutboundAddr()
+func ResolveHostAddrs(host, port string) ([]*_net.UDPAddr, error) {
+	portNum, err := GetPortAsInt(port)
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv6 addresses are often written in brackets, like they are in URLs.
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	ipAddr, zone := host, ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		ipAddr, zone = host[:i], host[i+1:]
+	}
+	if ip := _net.ParseIP(ipAddr); ip != nil {
+		return []*_net.UDPAddr{{IP: ip, Port: portNum, Zone: zone}}, nil
+	}
+
+	ips, err := _net.LookupIP(host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get this device's local IP address:"+
-			" %v", err)
+		return nil, fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	var addrs []*_net.UDPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, &_net.UDPAddr{IP: ip, Port: portNum})
+	}
+
+	return addrs, nil
+}
+
+// getInterfaceDiscoveryAddrs returns the UDP addresses that a message needs to
+// be sent to so that every device on the networks that the provided network
+// interface is on will receive it. ipNets are the networks that the interface
+// is on. Only the interface's own addresses and netmasks are used, so this
+// works the same way on networks without a default route or a DHCP server,
+// like an isolated switch or a cable between two machines.
+func getInterfaceDiscoveryAddrs(
+	iface *_net.Interface,
+	ipNets []*_net.IPNet,
+	port int,
+) []*_net.UDPAddr {
+	var addrs []*_net.UDPAddr
+	hasIPv6 := false
+	for _, ipNet := range ipNets {
+		if ipNet.IP.IsLoopback() {
+			continue
+		}
+		if ipNet.IP.To4() == nil {
+			hasIPv6 = true
+			continue
+		}
+		if iface.Flags&_net.FlagBroadcast == 0 {
+			continue
+		}
+		if broadcastIP := getBroadcastAddr(ipNet); broadcastIP != nil {
+			addrs = append(addrs, &_net.UDPAddr{IP: broadcastIP, Port: port})
+		}
+	}
+	if hasIPv6 && iface.Flags&_net.FlagMulticast != 0 {
+		// Link-local addresses only mean something alongside the interface
+		// that they're on.
+		addrs = append(addrs, &_net.UDPAddr{
+			IP:   _net.ParseIP(discoveryGroup),
+			Port: port,
+			Zone: iface.Name,
+		})
 	}
-	broadcastAddr := getBroadcastAddr(localAddr.String(), port)
-	broadcastUDPAddr, err := _net.ResolveUDPAddr("udp4", broadcastAddr)
+
+	return addrs
+}
+
+// GetLocalAddrs returns every IPv4 and IPv6 address that this device has on a
+// network interface that's up, other than loopback addresses, including
+// link-local ones like 169.254.0.0/16 and fe80::/10 addresses. These are the
+// addresses that other devices on its local networks could reach it at. Returns
+// an error if there aren't any.
+func GetLocalAddrs() ([]_net.IP, error) {
+	ifaces, err := GetInterfaces("")
 	if err != nil {
 		return nil, err
 	}
 
-	return broadcastUDPAddr, nil
+	var ips []_net.IP
+	for _, iface := range ifaces {
+		ipNets, err := getIPNets(&iface)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipNet := range ipNets {
+			if !ipNet.IP.IsLoopback() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, errors.New("this device doesn't have an IPv4 or IPv6" +
+			" address on any network")
+	}
+	return ips, nil
+}
+
+// ValidateInterface returns an error if this device doesn't have a network
+// interface with the provided name that lancp can broadcast on.
+func ValidateInterface(ifaceName string) error {
+	_, err := GetInterfaces(ifaceName)
+	return err
+}
+
+// GetInterfaces returns every network interface that's up, other than loopback
+// interfaces. If name isn't empty, it only returns the interface with that
+// name, and returns an error if there isn't one, or if it can't be used.
+func GetInterfaces(name string) ([]_net.Interface, error) {
+	if name != "" {
+		iface, err := _net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find network interface %s: %v",
+				name, err)
+		}
+		if iface.Flags&_net.FlagUp == 0 {
+			return nil, fmt.Errorf("network interface %s is down", name)
+		}
+		if iface.Flags&_net.FlagLoopback != 0 {
+			return nil, fmt.Errorf("network interface %s is a loopback"+
+				" interface", name)
+		}
+		return []_net.Interface{*iface}, nil
+	}
+
+	ifaces, err := _net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+	var upIfaces []_net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&_net.FlagUp == 0 || iface.Flags&_net.FlagLoopback != 0 {
+			continue
+		}
+		upIfaces = append(upIfaces, iface)
+	}
+
+	return upIfaces, nil
+}
+
+// getIPNets returns the IPv4 and IPv6 networks that the provided network
+// interface is on, along with its address on each of them.
+func getIPNets(iface *_net.Interface) ([]*_net.IPNet, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of network interface"+
+			" %s: %v", iface.Name, err)
+	}
+
+	var ipNets []*_net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*_net.IPNet); ok {
+			ipNets = append(ipNets, ipNet)
+		}
+	}
+
+	return ipNets, nil
 }
 
-// GetPreferredOutboundAddr finds this device's preferred outbound IPv4 address
-// on its local network. It prepares to send a UDP datagram to Google's DNS, but
-// doesn't actually send one.
-func GetPreferredOutboundAddr() (_net.IP, error) {
-	conn, err := _net.Dial("udp", "8.8.8.8:80")
+// multicastInterfaces returns every network interface that's up, supports
+// multicast, isn't a loopback interface, and has an IPv6 address.
+func multicastInterfaces() ([]_net.Interface, error) {
+	ifaces, err := GetInterfaces("")
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	preferredOutboundAddr := conn.LocalAddr().(*_net.UDPAddr)
 
-	return preferredOutboundAddr.IP, nil
+	var multicastIfaces []_net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&_net.FlagMulticast == 0 {
+			continue
+		}
+		ipNets, err := getIPNets(&iface)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipNet := range ipNets {
+			if ipNet.IP.To4() == nil {
+				multicastIfaces = append(multicastIfaces, iface)
+				break
+			}
+		}
+	}
+
+	return multicastIfaces, nil
 }
 
-// getLocalListeningAddress gets the local address of this machine and appends
-// the provided port string to it. Useful for matching a message's return
-// address with the local address of a machine to detect loopback messages.
+// isOwnAddr returns true if the provided address is one of the provided
+// interface addresses with the provided port on the end. Useful for detecting
+// loopback messages, like broadcast and multicast messages that get delivered
+// to the device who sent them.
 //
 // port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
-func getLocalListeningAddr(port string) (string, error) {
-	localAddr, err := GetPreferredOutboundAddr()
-	if err != nil {
-		return "", fmt.Errorf("failed to get this device's local IP address:"+
-			" %v", err)
+func isOwnAddr(addr _net.Addr, ownAddrs []_net.Addr, port string) bool {
+	udpAddr, ok := addr.(*_net.UDPAddr)
+	if !ok || ":"+strconv.Itoa(udpAddr.Port) != port {
+		return false
+	}
+	for _, ownAddr := range ownAddrs {
+		if ipNet, ok := ownAddr.(*_net.IPNet); ok &&
+			ipNet.IP.Equal(udpAddr.IP) {
+			return true
+		}
 	}
 
-	return localAddr.String() + port, nil
+	return false
 }
 
-// getBroadcastAddr accepts a device's preferred outbound IPv4 address, then
-// replaces the host bytes in that address with the broadcast host (all 1s).
-// After that, it tacks on the provided port number to the address.
-//
-// For instance, if this device's preferred local address is 192.168.0.69, then
-// getBroadcastAddr will return something like 192.168.0.255:8080.
+// getBroadcastAddr returns the directed broadcast address of the provided IPv4
+// network, which is its address with every host bit, the bits that aren't in
+// its netmask, set to 1. Returns nil if the network is too small to have a
+// broadcast address, like a point-to-point link's /31 or a single host's /32.
 //
-// https://stackoverflow.com/a/37382208
-func getBroadcastAddr(
-	preferredOutboundAddr string,
-	port string,
-) string {
-	// Remove host bytes.
-	hostBytesIndex := strings.LastIndex(preferredOutboundAddr, ".")
-	broadcastAddr := preferredOutboundAddr[:hostBytesIndex]
-	// Tack on broadcast host (all 1s) & the port number.
-	broadcastAddr += ".255" + port
-
-	return broadcastAddr
+// For instance, if this device's address is 192.168.5.69 on a /22 network,
+// then getBroadcastAddr will return 192.168.7.255.
+func getBroadcastAddr(ipNet *_net.IPNet) _net.IP {
+	ip := ipNet.IP.To4()
+	mask := ipNet.Mask
+	if len(mask) == _net.IPv6len {
+		mask = mask[12:]
+	}
+	if ip == nil || len(mask) != _net.IPv4len {
+		return nil
+	}
+	if ones, _ := mask.Size(); ones > 30 {
+		return nil
+	}
+
+	broadcastIP := make(_net.IP, _net.IPv4len)
+	for i := range ip {
+		broadcastIP[i] = ip[i] | ^mask[i]
+	}
+
+	return broadcastIP
 }
 
-// GetTLSAddress builds an address from a machine's IP and TLS port. It strips
+// GetTCPAddress builds an address from a machine's IP and TCP port. It strips
 // off the port number from the provided address, and tacks on the provided
 // port in its place.
 //
-// addr must be an IPv4 address. Assumed to already have a port number on it.
+// addr may be an IPv4 or IPv6 address, like the ones that net.Addr's String
+// method returns. Assumed to already have a port number on it.
 //
 // port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
-func GetTLSAddress(addr string, port string) string {
-	addr = addr[:strings.LastIndex(addr, ":")]
-	return addr + port
+func GetTCPAddress(addr string, port string) string {
+	host, _, err := _net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return _net.JoinHostPort(host, strings.TrimPrefix(port, ":"))
 }
@@ -0,0 +1,175 @@
+package net
+
+import (
+	_net "net"
+	"reflect"
+	"testing"
+)
+
+func TestGetTCPAddress(t *testing.T) {
+	tests := []struct {
+		addr        string
+		port        string
+		expectedRes string
+	}{
+		{"192.168.0.69:6969", ":6970", "192.168.0.69:6970"},
+		{"[2001:db8::69]:6969", ":6970", "[2001:db8::69]:6970"},
+		{"[fe80::69%eth0]:6969", ":6970", "[fe80::69%eth0]:6970"},
+		{"[::ffff:192.168.0.69]:6969", ":6970", "[::ffff:192.168.0.69]:6970"},
+	}
+
+	for _, c := range tests {
+		got := GetTCPAddress(c.addr, c.port)
+		if got != c.expectedRes {
+			t.Fatalf("unexpected result, got: %s\nwant: %s", got, c.expectedRes)
+		}
+	}
+}
+
+func TestIsOwnAddr(t *testing.T) {
+	ownAddrs := []_net.Addr{
+		&_net.IPNet{
+			IP:   _net.ParseIP("192.168.0.69"),
+			Mask: _net.CIDRMask(24, 32),
+		},
+		&_net.IPNet{
+			IP:   _net.ParseIP("fe80::69"),
+			Mask: _net.CIDRMask(64, 128),
+		},
+	}
+
+	tests := []struct {
+		addr        *_net.UDPAddr
+		expectedRes bool
+	}{
+		{&_net.UDPAddr{IP: _net.ParseIP("192.168.0.69"), Port: 6969}, true},
+		{&_net.UDPAddr{IP: _net.ParseIP("fe80::69"), Port: 6969,
+			Zone: "eth0"}, true},
+		{&_net.UDPAddr{IP: _net.ParseIP("192.168.0.69"), Port: 4242}, false},
+		{&_net.UDPAddr{IP: _net.ParseIP("192.168.0.42"), Port: 6969}, false},
+		{&_net.UDPAddr{IP: _net.ParseIP("fe80::42"), Port: 6969}, false},
+	}
+
+	for _, c := range tests {
+		got := isOwnAddr(c.addr, ownAddrs, ":6969")
+		if got != c.expectedRes {
+			t.Fatalf("unexpected result for %s, got: %t\nwant: %t", c.addr,
+				got, c.expectedRes)
+		}
+	}
+}
+
+func TestGetBroadcastAddr(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		expectedRes _net.IP
+	}{
+		{"192.168.0.69/24", _net.ParseIP("192.168.0.255")},
+		{"192.168.5.69/22", _net.ParseIP("192.168.7.255")},
+		{"10.1.2.3/8", _net.ParseIP("10.255.255.255")},
+		{"169.254.12.34/16", _net.ParseIP("169.254.255.255")},
+		{"172.16.0.1/30", _net.ParseIP("172.16.0.3")},
+		{"172.16.0.1/31", nil},
+		{"172.16.0.1/32", nil},
+		{"fe80::69/64", nil},
+	}
+
+	for _, c := range tests {
+		ip, ipNet, err := _net.ParseCIDR(c.cidr)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", c.cidr, err)
+		}
+		ipNet.IP = ip
+
+		got := getBroadcastAddr(ipNet)
+		if !got.Equal(c.expectedRes) {
+			t.Fatalf("unexpected result for %s, got: %s\nwant: %s", c.cidr,
+				got, c.expectedRes)
+		}
+	}
+}
+
+func TestGetInterfaceDiscoveryAddrs(t *testing.T) {
+	parseIPNets := func(cidrs ...string) []*_net.IPNet {
+		var ipNets []*_net.IPNet
+		for _, cidr := range cidrs {
+			ip, ipNet, err := _net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatalf("unexpected error parsing %s: %v", cidr, err)
+			}
+			ipNet.IP = ip
+			ipNets = append(ipNets, ipNet)
+		}
+		return ipNets
+	}
+	broadcastAndMulticast := _net.FlagUp | _net.FlagBroadcast |
+		_net.FlagMulticast
+
+	tests := []struct {
+		flags       _net.Flags
+		ipNets      []*_net.IPNet
+		expectedRes []string
+	}{
+		{
+			broadcastAndMulticast,
+			parseIPNets("192.168.5.69/22"),
+			[]string{"192.168.7.255:6969"},
+		},
+		{
+			broadcastAndMulticast,
+			parseIPNets("169.254.12.34/16", "fe80::69/64"),
+			[]string{"169.254.255.255:6969", "[ff02::6c61:6e63%eth0]:6969"},
+		},
+		{
+			broadcastAndMulticast,
+			parseIPNets("fe80::69/64"),
+			[]string{"[ff02::6c61:6e63%eth0]:6969"},
+		},
+		{
+			_net.FlagUp | _net.FlagPointToPoint,
+			parseIPNets("10.0.0.1/24", "fe80::69/64"),
+			nil,
+		},
+		{
+			broadcastAndMulticast,
+			parseIPNets("127.0.0.1/8", "::1/128"),
+			nil,
+		},
+	}
+
+	for _, c := range tests {
+		iface := &_net.Interface{Name: "eth0", Flags: c.flags}
+		var got []string
+		for _, addr := range getInterfaceDiscoveryAddrs(iface, c.ipNets,
+			6969) {
+			got = append(got, addr.String())
+		}
+		if !reflect.DeepEqual(got, c.expectedRes) {
+			t.Fatalf("unexpected result for %v, got: %v\nwant: %v", c.ipNets,
+				got, c.expectedRes)
+		}
+	}
+}
+
+func TestResolveHostAddrs(t *testing.T) {
+	tests := []struct {
+		host        string
+		expectedRes string
+	}{
+		{"192.168.0.69", "192.168.0.69:6969"},
+		{"2001:db8::69", "[2001:db8::69]:6969"},
+		{"fe80::69%eth0", "[fe80::69%eth0]:6969"},
+		{"[fe80::69%eth0]", "[fe80::69%eth0]:6969"},
+	}
+
+	for _, c := range tests {
+		got, err := ResolveHostAddrs(c.host, ":6969")
+		if err != nil {
+			t.Fatalf("unexpected error resolving %s: %v", c.host, err)
+		}
+		if len(got) != 1 || got[0].String() != c.expectedRes {
+			t.Fatalf("unexpected result for %s, got: %v\nwant: [%s]", c.host,
+				got, c.expectedRes)
+		}
+	}
+}
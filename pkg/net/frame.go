@@ -0,0 +1,331 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the version of the lancp wire protocol that this build
+// speaks. It must be bumped whenever a change is made to the protocol that an
+// older build wouldn't understand.
+const ProtocolVersion byte = 10
+
+// protocolMagic begins every lancp session, so that both ends can tell right
+// away if they've connected to something that isn't lancp.
+var protocolMagic = []byte("LANCP")
+
+const (
+	// frameHeaderLen is the number of bytes in a frame's header: one for its
+	// type, and four for the length of its payload.
+	frameHeaderLen = 5
+
+	// maxFrameLen is the largest payload that a frame can have. Anything
+	// larger is assumed to be garbage, rather than something worth allocating
+	// memory for.
+	maxFrameLen = 16 << 20
+
+	// maxDataFrameLen is the largest payload that a FrameWriter will put in a
+	// single frame.
+	maxDataFrameLen = 64 << 10
+)
+
+// FrameType identifies what a frame's payload contains.
+type FrameType byte
+
+// Every type of frame that lancp knows how to send. New types should only ever
+// be added to the end of this list, so that existing types keep their values.
+const (
+	// FrameManifest carries the list of files and directories that the sender
+	// is about to send.
+	FrameManifest FrameType = iota + 1
+
+	// FrameOffsets carries the offset that the receiver wants the sender to
+	// resume sending each file from.
+	FrameOffsets
+
+	// FrameData carries a piece of a file's contents.
+	FrameData
+
+	// FrameDigest marks the end of a file's contents, and carries the SHA-256
+	// digest of the whole file.
+	FrameDigest
+
+	// FrameVerified is sent by the receiver once it has checked every file's
+	// digest. It has no payload.
+	FrameVerified
+
+	// FrameError carries a human-readable message explaining why the peer
+	// gave up on the session.
+	FrameError
+
+	// FrameEncoding comes before each file's data frames when compression was
+	// agreed to during the handshake, and carries a byte that says how that
+	// file's contents are encoded.
+	FrameEncoding
+
+	// FrameStreams comes right after the manifest when sending over several
+	// connections was agreed to during the handshake, and carries the number
+	// of connections that the sender will send files' contents over.
+	FrameStreams
+
+	// FrameHello carries the sender's hostname, and comes right before the
+	// manifest.
+	FrameHello
+
+	// FrameAuth comes right after the preamble on every connection, and
+	// carries proof that the machine that sent it completed the handshake
+	// with us.
+	FrameAuth
+
+	// FrameCertificate begins the connection that a session begins on, and
+	// carries a machine's TLS certificate, along with a MAC that proves that
+	// it came from the machine that completed the handshake. Both machines
+	// send one before the connection is upgraded to TLS.
+	FrameCertificate
+
+	// FrameJoin begins each of the extra connections that files' contents are
+	// sent over, before they're upgraded to TLS, so that the receiver can tell
+	// them apart from the connection that the session began on. It has no
+	// payload.
+	FrameJoin
+
+	// FrameIdentity carries a machine's identity while it's being paired with
+	// another one, along with a MAC that proves that it came from the machine
+	// that completed the handshake. Both machines send one right after the
+	// preamble.
+	FrameIdentity
+)
+
+// String returns a human-readable name for the frame type.
+func (t FrameType) String() string {
+	switch t {
+	case FrameManifest:
+		return "manifest"
+	case FrameOffsets:
+		return "offsets"
+	case FrameData:
+		return "data"
+	case FrameDigest:
+		return "digest"
+	case FrameVerified:
+		return "verified"
+	case FrameError:
+		return "error"
+	case FrameEncoding:
+		return "encoding"
+	case FrameStreams:
+		return "streams"
+	case FrameHello:
+		return "hello"
+	case FrameAuth:
+		return "auth"
+	case FrameCertificate:
+		return "certificate"
+	case FrameJoin:
+		return "join"
+	case FrameIdentity:
+		return "identity"
+	default:
+		return fmt.Sprintf("unknown (%d)", byte(t))
+	}
+}
+
+// Frame is a single typed message in a lancp session.
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// WritePreamble writes the bytes that begin every lancp session: the protocol's
+// magic bytes, followed by the protocol version that this build speaks.
+func WritePreamble(w io.Writer) error {
+	_, err := w.Write(append(append([]byte{}, protocolMagic...),
+		ProtocolVersion))
+	return err
+}
+
+// ReadPreamble reads the bytes that begin a lancp session, and checks that the
+// peer speaks the same protocol version as this build. If it doesn't, the
+// returned error is a *VersionMismatchError.
+func ReadPreamble(r io.Reader) error {
+	preamble := make([]byte, len(protocolMagic)+1)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return fmt.Errorf("failed to read preamble: %v", err)
+	}
+	if !bytes.Equal(preamble[:len(protocolMagic)], protocolMagic) {
+		return errors.New("peer isn't speaking the lancp protocol")
+	}
+	if version := preamble[len(protocolMagic)]; version != ProtocolVersion {
+		return &VersionMismatchError{PeerVersion: version}
+	}
+
+	return nil
+}
+
+// VersionMismatchError is returned when a peer speaks a different version of
+// the lancp protocol than this build does.
+type VersionMismatchError struct {
+	PeerVersion byte
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("peer speaks lancp protocol version %d, but we speak"+
+		" version %d; upgrade lancp on the machine with the older version",
+		e.PeerVersion, ProtocolVersion)
+}
+
+// WriteFrame writes a frame with the provided type and payload to w.
+//
+// A frame is encoded as a byte for its type, the length of its payload as a
+// big-endian 32-bit integer, then its payload.
+func WriteFrame(w io.Writer, frameType FrameType, payload []byte) error {
+	if len(payload) > maxFrameLen {
+		return fmt.Errorf("%s frame is %d bytes long, max is %d",
+			frameType, len(payload), maxFrameLen)
+	}
+
+	var header [frameHeaderLen]byte
+	header[0] = byte(frameType)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads a whole frame from r. See WriteFrame for how frames are
+// encoded.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	frame := &Frame{Type: FrameType(header[0])}
+	payloadLen := binary.BigEndian.Uint32(header[1:])
+	if payloadLen > maxFrameLen {
+		return nil, fmt.Errorf("%s frame is %d bytes long, max is %d",
+			frame.Type, payloadLen, maxFrameLen)
+	}
+
+	frame.Payload = make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, fmt.Errorf("failed to read %s frame: %v", frame.Type, err)
+	}
+
+	return frame, nil
+}
+
+// FrameWriter is an io.Writer that wraps everything written to it in data
+// frames.
+type FrameWriter struct {
+	w io.Writer
+}
+
+// NewFrameWriter returns a pointer to a new FrameWriter struct which writes
+// data frames to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w}
+}
+
+// Write writes p to the underlying Writer in as many data frames as it takes.
+func (fw *FrameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxDataFrameLen {
+			chunk = chunk[:maxDataFrameLen]
+		}
+		if err := WriteFrame(fw.w, FrameData, chunk); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// FrameReader reads frames from an underlying Reader. It's also an io.Reader
+// that reads the payloads of consecutive data frames.
+type FrameReader struct {
+	r io.Reader
+
+	// data is what's left of the payload of the data frame that's currently
+	// being read.
+	data []byte
+
+	// next is a frame that was read while looking for a data frame, but isn't
+	// one.
+	next *Frame
+}
+
+// NewFrameReader returns a pointer to a new FrameReader struct which reads
+// frames from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r}
+}
+
+// Read reads the payloads of data frames into p. It returns io.EOF once it
+// reaches a frame that isn't a data frame. That frame is returned by the next
+// call to ReadFrame.
+func (fr *FrameReader) Read(p []byte) (int, error) {
+	for len(fr.data) == 0 {
+		if fr.next != nil {
+			return 0, io.EOF
+		}
+		frame, err := ReadFrame(fr.r)
+		if err != nil {
+			return 0, err
+		}
+		if frame.Type != FrameData {
+			fr.next = frame
+			return 0, io.EOF
+		}
+		fr.data = frame.Payload
+	}
+
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+// ReadFrame returns the next whole frame. If a data frame was only partially
+// read by Read, the rest of its payload is returned as a data frame.
+func (fr *FrameReader) ReadFrame() (*Frame, error) {
+	if len(fr.data) > 0 {
+		frame := &Frame{Type: FrameData, Payload: fr.data}
+		fr.data = nil
+		return frame, nil
+	}
+	if fr.next != nil {
+		frame := fr.next
+		fr.next = nil
+		return frame, nil
+	}
+
+	return ReadFrame(fr.r)
+}
+
+// ExpectFrame reads the next whole frame, and checks that it has the provided
+// type. If the peer sent an error frame instead, its message is returned as an
+// error.
+func (fr *FrameReader) ExpectFrame(frameType FrameType) (*Frame, error) {
+	frame, err := fr.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type == FrameError && frameType != FrameError {
+		return nil, fmt.Errorf("peer gave up: %s", frame.Payload)
+	}
+	if frame.Type != frameType {
+		return nil, fmt.Errorf("got %s frame, want %s frame",
+			frame.Type, frameType)
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,57 @@
+package net
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFrameReaderStopsAtNonDataFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	fw := NewFrameWriter(buf)
+	data := bytes.Repeat([]byte("lancp"), maxDataFrameLen/2)
+	if _, err := fw.Write(data); err != nil {
+		t.Fatalf("unexpected error writing data: %v", err)
+	}
+	if err := WriteFrame(buf, FrameDigest, []byte("digest")); err != nil {
+		t.Fatalf("unexpected error writing frame: %v", err)
+	}
+
+	fr := NewFrameReader(buf)
+	got, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("unexpected error reading data: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("unexpected data, got %d bytes, want %d bytes",
+			len(got), len(data))
+	}
+
+	frame, err := fr.ExpectFrame(FrameDigest)
+	if err != nil {
+		t.Fatalf("unexpected error reading frame: %v", err)
+	}
+	if string(frame.Payload) != "digest" {
+		t.Fatalf("unexpected payload, got: %q\nwant: %q",
+			frame.Payload, "digest")
+	}
+}
+
+func TestReadPreamble(t *testing.T) {
+	tests := []struct {
+		preamble    []byte
+		expectedErr bool
+	}{
+		{append([]byte("LANCP"), ProtocolVersion), false},
+		{append([]byte("LANCP"), ProtocolVersion+1), true},
+		{[]byte("HTTP/1"), true},
+		{[]byte("LAN"), true},
+	}
+
+	for _, c := range tests {
+		err := ReadPreamble(bytes.NewReader(c.preamble))
+		if (err != nil) != c.expectedErr {
+			t.Fatalf("unexpected error for preamble %q: %v", c.preamble, err)
+		}
+	}
+}
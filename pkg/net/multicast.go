@@ -0,0 +1,55 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	_net "net"
+	"syscall"
+)
+
+// JoinGroup joins the provided IPv4 or IPv6 multicast group on the provided
+// network interface, so that messages sent to that group on that interface are
+// delivered to the provided connection.
+func JoinGroup(
+	conn _net.PacketConn,
+	iface *_net.Interface,
+	group _net.IP,
+) error {
+	// IPv4 tells interfaces apart by one of their addresses, rather than by
+	// their index.
+	var ifaceIPv4 _net.IP
+	if group.To4() != nil {
+		ipNets, err := getIPNets(iface)
+		if err != nil {
+			return err
+		}
+		for _, ipNet := range ipNets {
+			if ipNet.IP.To4() != nil {
+				ifaceIPv4 = ipNet.IP
+				break
+			}
+		}
+		if ifaceIPv4 == nil {
+			return fmt.Errorf("network interface %s doesn't have an IPv4"+
+				" address", iface.Name)
+		}
+	}
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("connection doesn't have a socket")
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = joinGroup(fd, iface.Index, ifaceIPv4, group)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package net
+
+import (
+	"errors"
+	_net "net"
+)
+
+// joinGroup would set the socket option that joins the provided multicast
+// group, but lancp doesn't know how to on this platform. Devices on it can
+// still be reached over IPv4 broadcast.
+func joinGroup(fd uintptr, ifaceIndex int, ifaceIPv4, group _net.IP) error {
+	return errors.New("joining multicast groups isn't supported on this" +
+		" platform")
+}
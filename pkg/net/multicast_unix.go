@@ -0,0 +1,28 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package net
+
+import (
+	_net "net"
+	"syscall"
+)
+
+// joinGroup sets the socket option that joins the provided multicast group on
+// the socket with the provided file descriptor. IPv4 groups are joined on the
+// interface with the provided IPv4 address, and IPv6 groups are joined on the
+// interface with the provided index.
+func joinGroup(fd uintptr, ifaceIndex int, ifaceIPv4, group _net.IP) error {
+	if group4 := group.To4(); group4 != nil {
+		mreq := new(syscall.IPMreq)
+		copy(mreq.Multiaddr[:], group4)
+		copy(mreq.Interface[:], ifaceIPv4.To4())
+		return syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP,
+			syscall.IP_ADD_MEMBERSHIP, mreq)
+	}
+
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifaceIndex)}
+	copy(mreq.Multiaddr[:], group.To16())
+	return syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6,
+		syscall.IPV6_JOIN_GROUP, mreq)
+}
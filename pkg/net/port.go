@@ -1,6 +1,10 @@
 package net
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 const (
 	minValidPort = 1025
@@ -16,3 +20,15 @@ func GetPortAsString(port int) (string, error) {
 
 	return fmt.Sprintf(":%d", port), nil
 }
+
+// GetPortAsInt returns the port number in the provided port string, which needs
+// to be in the format ":0000(0)".
+func GetPortAsInt(port string) (int, error) {
+	portNum, err := strconv.Atoi(strings.TrimPrefix(port, ":"))
+	if err != nil || !strings.HasPrefix(port, ":") {
+		return 0, fmt.Errorf("port string must look like \":xxxx\", got: %q",
+			port)
+	}
+
+	return portNum, nil
+}
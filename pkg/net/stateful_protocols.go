@@ -1,8 +1,8 @@
 package net
 
 import (
+	"errors"
 	"fmt"
-	"io"
 	_net "net"
 	"time"
 )
@@ -39,87 +39,55 @@ func EstablishConn(
 	}
 }
 
-// SendMessage sends the provided byte slice along the provided connection.
-func SendMessage(message []byte, conn _net.Conn) error {
-	_, err := conn.Write(message)
-	return err
-}
-
-// ReceiveMessage blocks until it receives a message on the provided connection.
-// If it receives a message, it returns that message and the address of the
-// sender. If it doesn't receive a message within the specified timeout
-// duration, it returns an error that specifies such.
-//
-// TODO: write logic for retries. Have this function accept a # of retries as a
-// uint param.
-func ReceiveMessage(
-	conn _net.Conn,
-	timeoutDuration uint,
-) ([]byte, error) {
-	msgChan := make(chan []byte, 1)
-	errChan := make(chan error, 1)
-	go func() {
-		msg, err := io.ReadAll(conn)
-		if err != nil {
-			errChan <- err
-			return
-		}
-
-		msgChan <- msg
-	}()
-
-	select {
-	case msg := <-msgChan:
-		return msg, nil
-	case err := <-errChan:
+// AcceptFrom blocks until it receives an attempt to establish a connection on
+// the provided listener from the same IP address as peer, which is the address
+// of a machine that we completed the handshake with. Connections from anywhere
+// else are closed. If none arrives before deadline, it returns an error that
+// specifies such.
+func AcceptFrom(
+	ln _net.Listener,
+	peer _net.Addr,
+	deadline time.Time,
+) (_net.Conn, error) {
+	peerIP := getIP(peer)
+	if peerIP == nil {
+		return nil, fmt.Errorf("%v isn't an IP address", peer)
+	}
+	dl, ok := ln.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return nil, errors.New("listener doesn't support deadlines")
+	}
+	if err := dl.SetDeadline(deadline); err != nil {
 		return nil, err
-	case <-time.After(time.Duration(timeoutDuration) * time.Second):
-		return nil, fmt.Errorf("timed out after %d seconds", timeoutDuration)
 	}
-}
+	defer dl.SetDeadline(time.Time{})
 
-// FixedSizeMsg stores a byte slice and the number of bytes that were pushed to
-// that slice. The caller/user can choose whether or not to discard the
-// remaining bytes in the buffer. In most cases, they'll want to.
-type FixedSizeMsg struct {
-	Length int
-	Bytes  []byte
-}
-
-// ReceiveMessageWithKnownSize blocks until it receives a message on the
-// provided connection. It pushes that message into a fixed-size buffer of a
-// specified length. If it doesn't receive a message within the specified
-// timeout duration, it returns an error that specifies such.
-//
-// TODO: write logic for retries. Have this function accept a # of retries as a
-// uint param.
-func ReceiveMessageWithKnownSize(
-	size uint,
-	conn _net.Conn,
-	timeoutDuration uint,
-) (*FixedSizeMsg, error) {
-	msgChan := make(chan *FixedSizeMsg, 1)
-	errChan := make(chan error, 1)
-	go func() {
-		msgBuf := make([]byte, size)
-		n, err := conn.Read(msgBuf)
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			errChan <- err
-			return
+			var netErr _net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, fmt.Errorf("timed out waiting for %v to connect",
+					peerIP)
+			}
+			return nil, err
 		}
-
-		msgChan <- &FixedSizeMsg{
-			Length: n,
-			Bytes:  msgBuf,
+		if getIP(conn.RemoteAddr()).Equal(peerIP) {
+			return conn, nil
 		}
-	}()
+		conn.Close()
+	}
+}
 
-	select {
-	case msg := <-msgChan:
-		return msg, nil
-	case err := <-errChan:
-		return nil, err
-	case <-time.After(time.Duration(timeoutDuration) * time.Second):
-		return nil, fmt.Errorf("timed out after %d seconds", timeoutDuration)
+// getIP returns the IP address in the provided address, or nil if it doesn't
+// have one.
+func getIP(addr _net.Addr) _net.IP {
+	switch addr := addr.(type) {
+	case *_net.TCPAddr:
+		return addr.IP
+	case *_net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
 	}
 }
@@ -0,0 +1,80 @@
+package net
+
+import (
+	_net "net"
+	"testing"
+	"time"
+)
+
+func TestAcceptFrom(t *testing.T) {
+	ln, err := _net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := _net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+	probe, err := _net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback isn't available")
+	}
+	probe.Close()
+	// Listen on both loopback addresses, so that connections can come from
+	// two different places.
+	ln, err = _net.Listen("tcp", _net.JoinHostPort("::", port))
+	if err != nil {
+		t.Skipf("couldn't listen on IPv4 and IPv6 at once: %v", err)
+	}
+	defer ln.Close()
+
+	stranger, err := _net.Dial("tcp", _net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("unexpected error connecting over IPv4: %v", err)
+	}
+	defer stranger.Close()
+	peer, err := _net.Dial("tcp", _net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Fatalf("unexpected error connecting over IPv6: %v", err)
+	}
+	defer peer.Close()
+
+	conn, err := AcceptFrom(ln, &_net.UDPAddr{IP: _net.ParseIP("::1")},
+		time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != peer.LocalAddr().String() {
+		t.Fatalf("accepted connection from %s, want %s", got,
+			peer.LocalAddr())
+	}
+
+	// The connection from the other address was closed.
+	stranger.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = stranger.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection from another address wasn't closed")
+	}
+	if netErr, ok := err.(_net.Error); ok && netErr.Timeout() {
+		t.Fatal("connection from another address wasn't closed")
+	}
+}
+
+func TestAcceptFromTimesOut(t *testing.T) {
+	ln, err := _net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer ln.Close()
+	// Nobody connects from this address.
+	peer := &_net.UDPAddr{IP: _net.ParseIP("192.0.2.1")}
+	stranger, err := _net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	defer stranger.Close()
+
+	_, err = AcceptFrom(ln, peer, time.Now().Add(100*time.Millisecond))
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+}
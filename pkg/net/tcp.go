@@ -23,11 +23,11 @@ func CreateTCPListener(port string) (_net.Listener, error) {
 //
 // TODO: implement retry logic. Other machine may not have its listener ready to
 // go the first time we reach out to connect.
-func ConnectToTCPConn(addr _net.Addr, timeoutDuration uint) (_net.Conn, error) {
+func ConnectToTCPConn(addr string, timeoutDuration uint) (_net.Conn, error) {
 	connChan := make(chan _net.Conn, 1)
 	errChan := make(chan error, 1)
 	go func() {
-		conn, err := _net.Dial("tcp", addr.String())
+		conn, err := _net.Dial("tcp", addr)
 		if err != nil {
 			errChan <- err
 			return
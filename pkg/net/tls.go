@@ -2,51 +2,34 @@ package net
 
 import (
 	"crypto/tls"
-	"fmt"
 	_net "net"
-	"time"
+	"strings"
 )
 
-// CreateTLSListener returns a TLS listener for this machine on the provided
-// port. Caller is responsible for accepting incoming connection attempts on
-// that listener.
-//
-// Port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
-func CreateTLSListener(cfg *tls.Config, port string) (_net.Listener, error) {
-	return tls.Listen("tcp", port, cfg)
+// UpgradeToTLSServer returns a connection that carries out the server's side of
+// a TLS session over the provided connection, with the provided TLS config. The
+// TLS handshake happens the first time that it's read from or written to.
+func UpgradeToTLSServer(conn _net.Conn, cfg *tls.Config) *tls.Conn {
+	return tls.Server(conn, cfg)
 }
 
-// ConnectToTLSConn blocks as it attempts to connect to a TLS connection at the
-// provided address and with the provided TLS config. If it can't connect within
-// the specified timeout duration, it returns an error that specifies such.
-//
-// timeoutDuration is in seconds.
+// UpgradeToTLSClient returns a connection that carries out the client's side of
+// a TLS session over the provided connection, with the provided TLS config. The
+// TLS handshake happens the first time that it's read from or written to.
 //
-// TODO: implement retry logic. Other machine may not have its listener ready to
-// go the first time we reach out to connect.
-func ConnectToTLSConn(
-	addr string,
-	config *tls.Config,
-	timeoutDuration uint,
-) (*tls.Conn, error) {
-	connChan := make(chan *tls.Conn, 1)
-	errChan := make(chan error, 1)
-	go func() {
-		conn, err := tls.Dial("tcp", addr, config)
-		if err != nil {
-			errChan <- err
-			return
+// Unless the config says otherwise, the server's certificate is checked against
+// the address that the connection is connected to.
+func UpgradeToTLSClient(conn _net.Conn, cfg *tls.Config) *tls.Conn {
+	host, _, err := _net.SplitHostPort(conn.RemoteAddr().String())
+	if cfg.ServerName == "" && err == nil {
+		// Certificates can't say which network interface an IPv6 link-local
+		// address is on, so leave off the address's zone.
+		if i := strings.Index(host, "%"); i >= 0 {
+			host = host[:i]
 		}
-
-		connChan <- conn
-	}()
-
-	select {
-	case conn := <-connChan:
-		return conn, nil
-	case err := <-errChan:
-		return nil, err
-	case <-time.After(time.Duration(timeoutDuration) * time.Second):
-		return nil, fmt.Errorf("timed out after %d seconds", timeoutDuration)
+		cfg = cfg.Clone()
+		cfg.ServerName = host
 	}
+
+	return tls.Client(conn, cfg)
 }
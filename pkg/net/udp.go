@@ -1,18 +1,38 @@
 package net
 
 import (
+	"errors"
 	"fmt"
 	_net "net"
 	"time"
 )
 
 // TODO: make this user-configurable.
-const minPassphrasePayloadBufSize = 32
+const minPassphrasePayloadBufSize = 512
 
 // CreateUDPConn returns a UDP PacketConn for this machine on the provided port.
+// It receives messages sent over both IPv4 and IPv6, including ones sent to the
+// lancp IPv6 multicast group on any of this machine's network interfaces.
+//
 // Port needs to look like a port string (i.e., ":xxxx" or ":xxxxx").
 func CreateUDPConn(port string) (_net.PacketConn, error) {
-	return _net.ListenPacket("udp4", port)
+	conn, err := _net.ListenPacket("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := multicastInterfaces()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+	group := _net.ParseIP(discoveryGroup)
+	for i := range ifaces {
+		// Machines that can't join the group, like ones with IPv6 turned off,
+		// can still be reached over IPv4.
+		JoinGroup(conn, &ifaces[i], group)
+	}
+
+	return conn, nil
 }
 
 // SendUDPMessage sends the provided byte slice along the provided connection.
@@ -25,6 +45,31 @@ func SendUDPMessage(
 	return err
 }
 
+// SendUDPMessageToAll sends the provided byte slice along the provided
+// connection to each of the provided addresses, like the ones that
+// GetDiscoveryAddrs returns. It only returns an error if it couldn't send the
+// message to any of them.
+func SendUDPMessageToAll(
+	message []byte,
+	conn _net.PacketConn,
+	addrs []*_net.UDPAddr,
+) error {
+	var err error
+	sent := false
+	for _, addr := range addrs {
+		if sendErr := SendUDPMessage(message, conn, addr); sendErr != nil {
+			err = sendErr
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+
+	return err
+}
+
 // UDPMessage stores a message's contents, as well as the address of the sender.
 type UDPMessage struct {
 	// Payload is a message's contents.
@@ -34,13 +79,19 @@ type UDPMessage struct {
 	ReturnAddr _net.Addr
 }
 
+// ErrTimeout is wrapped by the error that ReceiveUDPMessage returns when it
+// doesn't receive a message in time.
+var ErrTimeout = errors.New("timed out")
+
 // ReceiveUDPMessage blocks until it receives a UDP message on the provided
 // connection. If it receives a message, it returns that message and the address
 // of the sender. If it doesn't receive a message within the specified timeout
-// duration, it returns an error that specifies such.
+// duration, it returns an error that wraps ErrTimeout.
 //
 // It discards its own messages, like broadcast messages that get delivered to
-// itself.
+// itself. They're recognized by comparing the sender's address with every
+// address on this machine's network interfaces, so it works on networks without
+// a default route, too.
 //
 // timeoutDuration is in seconds.
 //
@@ -50,40 +101,40 @@ func ReceiveUDPMessage(
 	timeoutDuration uint,
 	port string,
 ) (*UDPMessage, error) {
-	msgChan := make(chan *UDPMessage, 1)
-	errChan := make(chan error, 1)
-	go func() {
-		// TODO: either pass the buffer size in as a param, or eventually make
-		// this func a method on the HandshakeConductor struct (if you decide to
-		// use something like it again).
-		payloadBuf := make([]byte, minPassphrasePayloadBufSize)
+	ourAddrs, err := _net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get this device's IP addresses: %v",
+			err)
+	}
+	// A deadline, unlike waiting on a goroutine, doesn't leave anything
+	// behind that could swallow the next message.
+	err = conn.SetReadDeadline(time.Now().Add(
+		time.Duration(timeoutDuration) * time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	// TODO: either pass the buffer size in as a param, or eventually make this
+	// func a method on the HandshakeConductor struct (if you decide to use
+	// something like it again).
+	payloadBuf := make([]byte, minPassphrasePayloadBufSize)
+	for {
 		n, returnAddr, err := conn.ReadFrom(payloadBuf)
-		if err != nil {
-			errChan <- err
-			return
+		if netErr, ok := err.(_net.Error); ok && netErr.Timeout() {
+			return nil, fmt.Errorf("%w after %d seconds", ErrTimeout,
+				timeoutDuration)
 		}
-
-		// Discard our own broadcast message, and continue listening for one
-		// more message.
-		ourAddr, err := getLocalListeningAddr(port)
 		if err != nil {
-			errChan <- err
-			return
+			return nil, err
 		}
-		if returnAddr.String() == ourAddr {
-			n, returnAddr, err = conn.ReadFrom(payloadBuf)
+
+		// Discard our own broadcast messages, and continue listening.
+		if isOwnAddr(returnAddr, ourAddrs, port) {
+			continue
 		}
 
 		payload := string(payloadBuf[:n])
-		msgChan <- &UDPMessage{Payload: payload, ReturnAddr: returnAddr}
-	}()
-
-	select {
-	case msg := <-msgChan:
-		return msg, nil
-	case err := <-errChan:
-		return nil, err
-	case <-time.After(time.Duration(timeoutDuration) * time.Second):
-		return nil, fmt.Errorf("timed out after %d seconds", timeoutDuration)
+		return &UDPMessage{Payload: payload, ReturnAddr: returnAddr}, nil
 	}
 }
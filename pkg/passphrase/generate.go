@@ -1,278 +1,344 @@
 package passphrase
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"unicode"
 )
 
-// Generate returns a word from a list uniformly at random. The list contains
-// phonetically-distinct and relatively short English words.
-func Generate() string {
-	// Initialize global pseudo random number generator.
-	rand.Seed(time.Now().Unix())
+const (
+	// DefaultNumWords is the number of words in a passphrase unless the user
+	// asks for something else. Three is enough given the limit on attempts;
+	// see the README.
+	DefaultNumWords = 3
 
-	// TODO: have these options be read in from a file or something? Make that
-	// file location configurable?
-	//
-	// The binary we ship could be massive if we hard-code a bunch of strings
-	// in here like this...
-	passphrases := []string{
-		"absurd",
-		"accrue",
-		"adult",
-		"afflict",
-		"aftermath",
-		"ahead",
-		"aimless",
-		"allow",
-		"almighty",
-		"alone",
-		"ammo",
-		"amuse",
-		"ancient",
-		"antenna",
-		"apollo",
-		"apple",
-		"apply",
-		"article",
-		"artist",
-		"assume",
-		"asteroid",
-		"atas",
-		"athens",
-		"atlantic",
-		"atmosphere",
-		"aztec",
-		"backward",
-		"banjo",
-		"beam",
-		"blackjack",
-		"blockade",
-		"bodyguard",
-		"bookshelf",
-		"borderline",
-		"bravado",
-		"breakup",
-		"button",
-		"candidate",
-		"caravan",
-		"caretaker",
-		"celebrate",
-		"cement",
-		"certify",
-		"chatter",
-		"checkup",
-		"chicago",
-		"chisel",
-		"christmas",
-		"classic",
-		"classroom",
-		"cobra",
-		"combustion",
-		"commence",
-		"company",
-		"component",
-		"concert",
-		"concurrent",
-		"confidence",
-		"congregate",
-		"consult",
-		"corporate",
-		"crossover",
-		"crucial",
-		"cumbersome",
-		"customer",
-		"dashboard",
-		"december",
-		"decimal",
-		"design",
-		"detect",
-		"determine",
-		"dinosaur",
-		"direction",
-		"disable",
-		"disbelief",
-		"disrupt",
-		"distortion",
-		"document",
-		"drain",
-		"dreadful",
-		"drift",
-		"dropper",
-		"dwelling",
-		"eating",
-		"enchanting",
-		"endorse",
-		"enlist",
-		"enrollment",
-		"enterprise",
-		"equation",
-		"equipment",
-		"erase",
-		"escape",
-		"examine",
-		"exceed",
-		"existence",
-		"fascinate",
-		"forever",
-		"fracture",
-		"framework",
-		"freedom",
-		"frequency",
-		"frighten",
-		"glitter",
-		"glossary",
-		"goldfish",
-		"graduate",
-		"gravity",
-		"guidance",
-		"hamburger",
-		"hamilton",
-		"hazard",
-		"hesitate",
-		"hockey",
-		"hurricane",
-		"hydraulic",
-		"impartial",
-		"inception",
-		"indigo",
-		"indoors",
-		"indulge",
-		"inertia",
-		"infancy",
-		"inferno",
-		"informant",
-		"insurgent",
-		"integrate",
-		"intention",
-		"invent",
-		"inverse",
-		"involve",
-		"island",
-		"jupiter",
-		"keyboard",
-		"kickoff",
-		"kiwi",
-		"liberty",
-		"maverick",
-		"medusa",
-		"merit",
-		"microscope",
-		"microwave",
-		"millionaire",
-		"miracle",
-		"molecule",
-		"montana",
-		"monument",
-		"music",
-		"narrative",
-		"necklace",
-		"neptune",
-		"newborn",
-		"oakland",
-		"obtuse",
-		"october",
-		"ohio",
-		"optic",
-		"orlando",
-		"pacific",
-		"pandemic",
-		"pandora",
-		"paragraph",
-		"paramount",
-		"passenger",
-		"peachy",
-		"performance",
-		"photograph",
-		"pioneer",
-		"pluto",
-		"polite",
-		"positive",
-		"potato",
-		"prefer",
-		"printer",
-		"processor",
-		"publisher",
-		"puppy",
-		"pyramid",
-		"python",
-		"quadrant",
-		"quantity",
-		"quota",
-		"rebellion",
-		"rebirth",
-		"recipe",
-		"recover",
-		"reform",
-		"regain",
-		"rematch",
-		"repay",
-		"repellent",
-		"replica",
-		"responsive",
-		"retract",
-		"retrieve",
-		"retrospect",
-		"revenge",
-		"revenue",
-		"revival",
-		"reward",
-		"robust",
-		"saturday",
-		"scavenger",
-		"scenic",
-		"scotland",
-		"select",
-		"sentence",
-		"shadow",
-		"slingshot",
-		"snapshot",
-		"sociable",
-		"solo",
-		"specialist",
-		"speculate",
-		"stagnate",
-		"stairway",
-		"standard",
-		"stapler",
-		"stupendous",
-		"surrender",
-		"suspense",
-		"suspicious",
-		"tactic",
-		"telephone",
-		"tiger",
-		"tissue",
-		"tolerance",
-		"tomorrow",
-		"torpedo",
-		"tracker",
-		"tradition",
-		"transmit",
-		"trauma",
-		"treadmill",
-		"trouble",
-		"tunnel",
-		"typewriter",
-		"ultimate",
-		"unicorn",
-		"unify",
-		"universe",
-		"unravel",
-		"upcoming",
-		"uproot",
-		"upset",
-		"village",
-		"virginia",
-		"virus",
-		"visitor",
-		"voyager",
-		"waffle",
-		"wallet",
-		"warranty",
-		"whimsical",
-		"wyoming",
+	// MaxNumWords is the most words that a passphrase can have. Anything
+	// longer is a pain to type in.
+	MaxNumWords = 10
+
+	// numberLimit is one more than the largest number that can end a
+	// passphrase.
+	numberLimit = 1000
+
+	// separator goes between the pieces of a passphrase.
+	separator = "-"
+)
+
+// Generate returns numWords words chosen uniformly at random from a list of
+// phonetically-distinct and relatively short English words, separated by
+// hyphens. If withNumber is true, a number from 0 to 999 is tacked on, too.
+//
+// numWords must be between 1 and MaxNumWords.
+func Generate(numWords int, withNumber bool) (string, error) {
+	if numWords < 1 || numWords > MaxNumWords {
+		return "", fmt.Errorf("got %d words, want between 1 and %d", numWords,
+			MaxNumWords)
+	}
+
+	pieces := make([]string, 0, numWords+1)
+	for i := 0; i < numWords; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+		if err != nil {
+			return "", err
+		}
+		pieces = append(pieces, words[n.Int64()])
+	}
+	if withNumber {
+		n, err := rand.Int(rand.Reader, big.NewInt(numberLimit))
+		if err != nil {
+			return "", err
+		}
+		pieces = append(pieces, n.String())
 	}
 
-	return passphrases[rand.Intn(len(passphrases))]
+	return strings.Join(pieces, separator), nil
+}
+
+// Entropy returns the number of bits of entropy in passphrases returned by
+// Generate with the same arguments. Each bit doubles the number of guesses that
+// someone would need to make to be sure that they guessed it.
+func Entropy(numWords int, withNumber bool) float64 {
+	bits := float64(numWords) * math.Log2(float64(len(words)))
+	if withNumber {
+		bits += math.Log2(numberLimit)
+	}
+	return bits
+}
+
+// Normalize returns the provided passphrase, as a user typed it in, in the same
+// form that Generate returns passphrases in. Capital letters are made
+// lowercase, and each run of spaces or punctuation between words is replaced
+// with a single hyphen, so that "Banjo  Waffle" matches "banjo-waffle".
+func Normalize(passphrase string) string {
+	pieces := strings.FieldsFunc(strings.ToLower(passphrase),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	return strings.Join(pieces, separator)
+}
+
+// TODO: have these options be read in from a file or something? Make that
+// file location configurable?
+//
+// The binary we ship could be massive if we hard-code a bunch of strings in
+// here like this...
+var words = []string{
+	"absurd",
+	"accrue",
+	"adult",
+	"afflict",
+	"aftermath",
+	"ahead",
+	"aimless",
+	"allow",
+	"almighty",
+	"alone",
+	"ammo",
+	"amuse",
+	"ancient",
+	"antenna",
+	"apollo",
+	"apple",
+	"apply",
+	"article",
+	"artist",
+	"assume",
+	"asteroid",
+	"atas",
+	"athens",
+	"atlantic",
+	"atmosphere",
+	"aztec",
+	"backward",
+	"banjo",
+	"beam",
+	"blackjack",
+	"blockade",
+	"bodyguard",
+	"bookshelf",
+	"borderline",
+	"bravado",
+	"breakup",
+	"button",
+	"candidate",
+	"caravan",
+	"caretaker",
+	"celebrate",
+	"cement",
+	"certify",
+	"chatter",
+	"checkup",
+	"chicago",
+	"chisel",
+	"christmas",
+	"classic",
+	"classroom",
+	"cobra",
+	"combustion",
+	"commence",
+	"company",
+	"component",
+	"concert",
+	"concurrent",
+	"confidence",
+	"congregate",
+	"consult",
+	"corporate",
+	"crossover",
+	"crucial",
+	"cumbersome",
+	"customer",
+	"dashboard",
+	"december",
+	"decimal",
+	"design",
+	"detect",
+	"determine",
+	"dinosaur",
+	"direction",
+	"disable",
+	"disbelief",
+	"disrupt",
+	"distortion",
+	"document",
+	"drain",
+	"dreadful",
+	"drift",
+	"dropper",
+	"dwelling",
+	"eating",
+	"enchanting",
+	"endorse",
+	"enlist",
+	"enrollment",
+	"enterprise",
+	"equation",
+	"equipment",
+	"erase",
+	"escape",
+	"examine",
+	"exceed",
+	"existence",
+	"fascinate",
+	"forever",
+	"fracture",
+	"framework",
+	"freedom",
+	"frequency",
+	"frighten",
+	"glitter",
+	"glossary",
+	"goldfish",
+	"graduate",
+	"gravity",
+	"guidance",
+	"hamburger",
+	"hamilton",
+	"hazard",
+	"hesitate",
+	"hockey",
+	"hurricane",
+	"hydraulic",
+	"impartial",
+	"inception",
+	"indigo",
+	"indoors",
+	"indulge",
+	"inertia",
+	"infancy",
+	"inferno",
+	"informant",
+	"insurgent",
+	"integrate",
+	"intention",
+	"invent",
+	"inverse",
+	"involve",
+	"island",
+	"jupiter",
+	"keyboard",
+	"kickoff",
+	"kiwi",
+	"liberty",
+	"maverick",
+	"medusa",
+	"merit",
+	"microscope",
+	"microwave",
+	"millionaire",
+	"miracle",
+	"molecule",
+	"montana",
+	"monument",
+	"music",
+	"narrative",
+	"necklace",
+	"neptune",
+	"newborn",
+	"oakland",
+	"obtuse",
+	"october",
+	"ohio",
+	"optic",
+	"orlando",
+	"pacific",
+	"pandemic",
+	"pandora",
+	"paragraph",
+	"paramount",
+	"passenger",
+	"peachy",
+	"performance",
+	"photograph",
+	"pioneer",
+	"pluto",
+	"polite",
+	"positive",
+	"potato",
+	"prefer",
+	"printer",
+	"processor",
+	"publisher",
+	"puppy",
+	"pyramid",
+	"python",
+	"quadrant",
+	"quantity",
+	"quota",
+	"rebellion",
+	"rebirth",
+	"recipe",
+	"recover",
+	"reform",
+	"regain",
+	"rematch",
+	"repay",
+	"repellent",
+	"replica",
+	"responsive",
+	"retract",
+	"retrieve",
+	"retrospect",
+	"revenge",
+	"revenue",
+	"revival",
+	"reward",
+	"robust",
+	"saturday",
+	"scavenger",
+	"scenic",
+	"scotland",
+	"select",
+	"sentence",
+	"shadow",
+	"slingshot",
+	"snapshot",
+	"sociable",
+	"solo",
+	"specialist",
+	"speculate",
+	"stagnate",
+	"stairway",
+	"standard",
+	"stapler",
+	"stupendous",
+	"surrender",
+	"suspense",
+	"suspicious",
+	"tactic",
+	"telephone",
+	"tiger",
+	"tissue",
+	"tolerance",
+	"tomorrow",
+	"torpedo",
+	"tracker",
+	"tradition",
+	"transmit",
+	"trauma",
+	"treadmill",
+	"trouble",
+	"tunnel",
+	"typewriter",
+	"ultimate",
+	"unicorn",
+	"unify",
+	"universe",
+	"unravel",
+	"upcoming",
+	"uproot",
+	"upset",
+	"village",
+	"virginia",
+	"virus",
+	"visitor",
+	"voyager",
+	"waffle",
+	"wallet",
+	"warranty",
+	"whimsical",
+	"wyoming",
 }
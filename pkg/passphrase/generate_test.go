@@ -0,0 +1,77 @@
+package passphrase
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	isWord := make(map[string]bool)
+	for _, word := range words {
+		isWord[word] = true
+	}
+
+	for _, numWords := range []int{1, DefaultNumWords, MaxNumWords} {
+		for _, withNumber := range []bool{false, true} {
+			got, err := Generate(numWords, withNumber)
+			if err != nil {
+				t.Fatalf("unexpected error generating passphrase: %v", err)
+			}
+			pieces := strings.Split(got, separator)
+			if withNumber {
+				n, err := strconv.Atoi(pieces[len(pieces)-1])
+				if err != nil || n < 0 || n >= numberLimit {
+					t.Fatalf("expected %q to end with a number from 0 to"+
+						" %d", got, numberLimit-1)
+				}
+				pieces = pieces[:len(pieces)-1]
+			}
+			if len(pieces) != numWords {
+				t.Fatalf("unexpected number of words in %q, got: %d\nwant:"+
+					" %d", got, len(pieces), numWords)
+			}
+			for _, piece := range pieces {
+				if !isWord[piece] {
+					t.Fatalf("unexpected word in %q: %q", got, piece)
+				}
+			}
+			if Normalize(got) != got {
+				t.Fatalf("expected %q to already be normalized", got)
+			}
+		}
+	}
+}
+
+func TestGenerateRejectsBadLengths(t *testing.T) {
+	for _, numWords := range []int{-1, 0, MaxNumWords + 1} {
+		if _, err := Generate(numWords, false); err == nil {
+			t.Fatalf("expected an error generating %d words", numWords)
+		}
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	perWord := math.Log2(float64(len(words)))
+	if got := Entropy(3, false); math.Abs(got-3*perWord) > 1e-9 {
+		t.Fatalf("unexpected entropy, got: %f\nwant: %f", got, 3*perWord)
+	}
+	if got := Entropy(3, true); got <= Entropy(3, false) {
+		t.Fatalf("expected a number to add entropy, got: %f", got)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for input, want := range map[string]string{
+		"banjo-waffle":         "banjo-waffle",
+		"Banjo  Waffle":        "banjo-waffle",
+		" banjo_waffle 42\r\n": "banjo-waffle-42",
+		"":                     "",
+	} {
+		if got := Normalize(input); got != want {
+			t.Fatalf("unexpected normalized passphrase for %q, got: %q\n"+
+				"want: %q", input, got, want)
+		}
+	}
+}